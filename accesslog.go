@@ -0,0 +1,286 @@
+package urlshort
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogFormat is the format of access log lines.
+type LogFormat string
+
+// The supported access log formats.
+const (
+	LogJSON   LogFormat = "json"
+	LogLogfmt LogFormat = "logfmt"
+)
+
+// AccessLogConfig tunes an AccessLog. Zero fields get defaults.
+type AccessLogConfig struct {
+	Format LogFormat // default LogJSON
+	// SampleAfter enables sampling: once a link has been
+	// requested SampleAfter times in a second, only one in
+	// SampleRate further requests for it are logged, that
+	// second. Requests matching no link are sampled together.
+	// Zero logs every request.
+	SampleAfter int
+	SampleRate  int // default 100
+}
+
+// AccessLog is middleware writing one line per request, in JSON
+// or logfmt, with the rule matched, the redirect target, the
+// status, the latency and the client. Lines carry a sample_rate
+// field telling how many requests each stands for.
+type AccessLog struct {
+	format  LogFormat
+	sampler *sampler // nil without sampling
+
+	mu sync.Mutex // serialises writes, so lines never interleave
+	w  io.Writer
+}
+
+// NewAccessLog returns an AccessLog writing to w, such as
+// os.Stdout, a RotatingFile or a syslog writer. Each line is
+// written with a single call to w.Write.
+func NewAccessLog(w io.Writer, cfg AccessLogConfig) (*AccessLog, error) {
+	switch cfg.Format {
+	case "":
+		cfg.Format = LogJSON
+	case LogJSON, LogLogfmt:
+	default:
+		return nil, fmt.Errorf("urlshort: unknown log format %q", cfg.Format)
+	}
+	if cfg.SampleRate <= 0 {
+		cfg.SampleRate = 100
+	}
+	l := &AccessLog{format: cfg.Format, w: w}
+	if cfg.SampleAfter > 0 {
+		l.sampler = &sampler{after: cfg.SampleAfter, rate: cfg.SampleRate}
+	}
+	return l, nil
+}
+
+// Instrument returns a handler serving requests with next and
+// logging them.
+func (l *AccessLog) Instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r, info := withRequestInfo(r)
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+
+		rate := 1
+		if l.sampler != nil {
+			if rate = l.sampler.sample(info.link, start); rate == 0 {
+				return
+			}
+		}
+		l.write([]logField{
+			{"time", start.UTC().Format(time.RFC3339Nano)},
+			{"method", r.Method},
+			{"host", r.Host},
+			{"path", r.URL.Path},
+			{"rule", info.link},
+			{"outcome", info.outcome},
+			{"target", sw.Header().Get("Location")},
+			{"status", sw.status},
+			{"bytes", sw.bytes},
+			{"latency_ms", float64(time.Since(start).Microseconds()) / 1000},
+			{"client", clientIP(r)},
+			{"user_agent", r.UserAgent()},
+			{"referrer", r.Referer()},
+			{"sample_rate", rate},
+		})
+	})
+}
+
+// sampler counts the requests for each link in windows of one
+// second, and picks those to log once there are too many.
+type sampler struct {
+	after int // requests logged in full in each window
+	rate  int // one in rate of the others is logged
+
+	mu     sync.Mutex
+	start  time.Time      // of the current window
+	counts map[string]int // requests per link in the window
+}
+
+// sample records a request for link at now. It returns the
+// number of requests the log line stands for, or 0 if the
+// request is not logged.
+func (s *sampler) sample(link string, now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.counts == nil || now.Sub(s.start) >= time.Second {
+		s.start = now
+		s.counts = make(map[string]int)
+	}
+	s.counts[link]++
+	switch n := s.counts[link] - s.after; {
+	case n <= 0:
+		return 1
+	case n%s.rate == 0:
+		return s.rate
+	}
+	return 0
+}
+
+type logField struct {
+	key   string
+	value interface{}
+}
+
+func (l *AccessLog) write(fields []logField) {
+	var b bytes.Buffer
+	if l.format == LogLogfmt {
+		for i, f := range fields {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(f.key)
+			b.WriteByte('=')
+			b.WriteString(logfmtValue(f.value))
+		}
+	} else {
+		b.WriteByte('{')
+		for i, f := range fields {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			k, _ := json.Marshal(f.key)
+			v, _ := json.Marshal(f.value)
+			b.Write(k)
+			b.WriteByte(':')
+			b.Write(v)
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte('\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(b.Bytes())
+}
+
+// logfmtValue formats v for logfmt, quoting it when needed.
+func logfmtValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\\") || strings.IndexFunc(s, func(r rune) bool { return r < ' ' }) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// RotatingFile is an io.WriteCloser appending to a file, which
+// it rotates once it grows past a size: path is renamed to
+// path.1, path.1 to path.2 and so on, keeping a fixed number of
+// old files.
+type RotatingFile struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// OpenRotatingFile opens (creating if needed) the file at path
+// for appending, rotating it when it reaches maxSize bytes and
+// keeping keep old files.
+func OpenRotatingFile(path string, maxSize int64, keep int) (*RotatingFile, error) {
+	rf := &RotatingFile{path: path, maxSize: maxSize, keep: keep}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, fi.Size()
+	return nil
+}
+
+// Write implements io.Writer. A write is never split across
+// files.
+func (rf *RotatingFile) Write(b []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.size > 0 && rf.size+int64(len(b)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(b)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and opens a new one.
+// rf.mu must be held.
+func (rf *RotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	rf.f = nil
+	var err error
+	if rf.keep > 0 {
+		os.Remove(rf.backup(rf.keep))
+		for i := rf.keep - 1; i >= 1; i-- {
+			os.Rename(rf.backup(i), rf.backup(i+1))
+		}
+		err = os.Rename(rf.path, rf.backup(1))
+	} else {
+		err = os.Remove(rf.path)
+	}
+	if err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+func (rf *RotatingFile) backup(i int) string {
+	return rf.path + "." + strconv.Itoa(i)
+}
+
+// Close closes the file.
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package urlshort
+
+import (
+	"errors"
+	"io"
+)
+
+// DialSyslog is not supported on this system.
+func DialSyslog(tag string) (io.WriteCloser, error) {
+	return nil, errors.New("urlshort: syslog is not supported on this system")
+}
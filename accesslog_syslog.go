@@ -0,0 +1,16 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package urlshort
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// DialSyslog returns a writer sending access log lines to the
+// local syslog daemon through its Unix socket, tagged with tag,
+// for use with NewAccessLog.
+func DialSyslog(tag string) (io.WriteCloser, error) {
+	return syslog.Dial("", "", syslog.LOG_INFO|syslog.LOG_LOCAL0, tag)
+}
@@ -0,0 +1,108 @@
+package urlshort
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	h := MapHandler(map[string]string{"/a": "https://a.example"}, http.HandlerFunc(fallback))
+	var buf bytes.Buffer
+	al, err := NewAccessLog(&buf, AccessLogConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/a", nil)
+	req.Header.Set("User-Agent", "test agent")
+	al.Instrument(h).ServeHTTP(httptest.NewRecorder(), req)
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("line %q: %v", buf.String(), err)
+	}
+	for k, want := range map[string]interface{}{
+		"rule":        "/a",
+		"outcome":     "redirect",
+		"target":      "https://a.example",
+		"status":      float64(302),
+		"client":      "192.0.2.1",
+		"user_agent":  "test agent",
+		"sample_rate": float64(1),
+	} {
+		if line[k] != want {
+			t.Errorf("%s = %v, want %v", k, line[k], want)
+		}
+	}
+
+	buf.Reset()
+	al, err = NewAccessLog(&buf, AccessLogConfig{Format: LogLogfmt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	al.Instrument(h).ServeHTTP(httptest.NewRecorder(), req)
+	for _, want := range []string{" rule=/a ", " status=302 ", ` user_agent="test agent" `, " referrer=\"\" "} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("logfmt line %q lacks %q", buf.String(), want)
+		}
+	}
+
+	if _, err := NewAccessLog(&buf, AccessLogConfig{Format: "xml"}); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	h := MapHandler(map[string]string{"/a": "https://a.example"}, http.HandlerFunc(fallback))
+	var buf bytes.Buffer
+	al, err := NewAccessLog(&buf, AccessLogConfig{SampleAfter: 5, SampleRate: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ih := al.Instrument(h)
+	// Unless the second turns over, 5 requests are logged, then
+	// one in ten of the next 30.
+	for i := 0; i < 35; i++ {
+		ih.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/a", nil))
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) < 8 {
+		t.Fatalf("logged %d lines, want at least 8", len(lines))
+	}
+	if len(lines) == 8 && !strings.Contains(lines[7], `"sample_rate":10`) {
+		t.Errorf("sampled line %s", lines[7])
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	rf, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "zero" is rotated away.
+	for _, line := range []string{"zero\n", "zero\n", "one\n", "two\n", "three\n", "four\n", "five\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rf.Close()
+	for file, want := range map[string]string{
+		path:        "four\nfive\n",
+		path + ".1": "three\n",
+		path + ".2": "one\ntwo\n",
+	} {
+		b, err := ioutil.ReadFile(file)
+		if err != nil || string(b) != want {
+			t.Errorf("%s = %q, %v; want %q", file, b, err, want)
+		}
+	}
+	if _, err := ioutil.ReadFile(path + ".3"); err == nil {
+		t.Error("more than 2 old files kept")
+	}
+}
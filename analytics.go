@@ -0,0 +1,222 @@
+package urlshort
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Hit is one redirect served for a link.
+type Hit struct {
+	Time      time.Time `json:"time"`
+	Path      string    `json:"path"` // key of the link, not path of the request
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	// IPHash is a salted hash of the client address, so visits
+	// can be told apart without storing addresses.
+	IPHash string `json:"ip_hash,omitempty"`
+}
+
+// HitStore is implemented by stores that can keep hits.
+type HitStore interface {
+	// RecordHits stores a batch of hits.
+	RecordHits(hits []Hit) error
+}
+
+// RecorderConfig tunes a Recorder. Zero fields get defaults.
+type RecorderConfig struct {
+	Buffer        int           // hits queued before new ones are dropped; default 10000
+	BatchSize     int           // hits written at once; default 500
+	FlushInterval time.Duration // longest a hit waits to be written; default 1s
+	// Salt is mixed into client address hashes. Keep it secret
+	// and constant to recognise returning visitors across
+	// restarts; by default a random one is used.
+	Salt   []byte
+	Logger *log.Logger // for write errors; default standard error
+}
+
+// Recorder collects hits in the background and writes them to a
+// HitStore in batches, so that recording never slows down a
+// redirect. When the queue is full new hits are dropped and
+// counted rather than blocking the request.
+type Recorder struct {
+	sink     HitStore
+	hits     chan Hit
+	batch    int
+	interval time.Duration
+	salt     []byte
+	logger   *log.Logger
+
+	dropped  uint64
+	failed   uint64
+	recorded uint64
+
+	flush     chan chan struct{}
+	stop      chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewRecorder starts a Recorder writing to sink. Call Close to
+// write the pending hits and stop it.
+func NewRecorder(sink HitStore, cfg RecorderConfig) *Recorder {
+	if cfg.Buffer <= 0 {
+		cfg.Buffer = 10000
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 500
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
+	}
+	if cfg.Salt == nil {
+		cfg.Salt = randomSecret()
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	rec := &Recorder{
+		sink:     sink,
+		hits:     make(chan Hit, cfg.Buffer),
+		batch:    cfg.BatchSize,
+		interval: cfg.FlushInterval,
+		salt:     cfg.Salt,
+		logger:   cfg.Logger,
+		flush:    make(chan chan struct{}),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go rec.loop()
+	return rec
+}
+
+// Record queues a hit for the link stored under key, served for
+// r. It never blocks.
+func (rec *Recorder) Record(key string, r *http.Request) {
+	h := Hit{
+		Time:      time.Now().UTC(),
+		Path:      key,
+		Referrer:  r.Referer(),
+		UserAgent: r.UserAgent(),
+		IPHash:    rec.hashIP(clientIP(r)),
+	}
+	select {
+	case rec.hits <- h:
+	default:
+		atomic.AddUint64(&rec.dropped, 1)
+	}
+}
+
+// Dropped returns the number of hits dropped because the queue
+// was full.
+func (rec *Recorder) Dropped() uint64 {
+	return atomic.LoadUint64(&rec.dropped)
+}
+
+// Failed returns the number of hits lost to store errors.
+func (rec *Recorder) Failed() uint64 {
+	return atomic.LoadUint64(&rec.failed)
+}
+
+// Recorded returns the number of hits written to the store.
+func (rec *Recorder) Recorded() uint64 {
+	return atomic.LoadUint64(&rec.recorded)
+}
+
+// Flush writes the queued hits and waits until they are stored.
+func (rec *Recorder) Flush() {
+	ack := make(chan struct{})
+	select {
+	case rec.flush <- ack:
+		<-ack
+	case <-rec.done:
+	}
+}
+
+// Close writes the queued hits and stops the recorder. Hits
+// recorded after Close are dropped.
+func (rec *Recorder) Close() error {
+	rec.closeOnce.Do(func() {
+		close(rec.stop)
+		<-rec.done
+	})
+	return nil
+}
+
+func (rec *Recorder) loop() {
+	defer close(rec.done)
+	tick := time.NewTicker(rec.interval)
+	defer tick.Stop()
+	batch := make([]Hit, 0, rec.batch)
+	for {
+		select {
+		case h := <-rec.hits:
+			batch = append(batch, h)
+			if len(batch) >= rec.batch {
+				batch = rec.write(batch)
+			}
+		case <-tick.C:
+			batch = rec.write(batch)
+		case ack := <-rec.flush:
+			batch = rec.drain(batch)
+			close(ack)
+		case <-rec.stop:
+			rec.drain(batch)
+			return
+		}
+	}
+}
+
+// drain writes batch and everything queued.
+func (rec *Recorder) drain(batch []Hit) []Hit {
+	for {
+		select {
+		case h := <-rec.hits:
+			batch = append(batch, h)
+			if len(batch) >= rec.batch {
+				batch = rec.write(batch)
+			}
+		default:
+			return rec.write(batch)
+		}
+	}
+}
+
+// write stores batch and returns it emptied for reuse.
+func (rec *Recorder) write(batch []Hit) []Hit {
+	if len(batch) == 0 {
+		return batch
+	}
+	if err := rec.sink.RecordHits(batch); err != nil {
+		atomic.AddUint64(&rec.failed, uint64(len(batch)))
+		rec.logger.Printf("urlshort: recording %d hits: %v", len(batch), err)
+	} else {
+		atomic.AddUint64(&rec.recorded, uint64(len(batch)))
+	}
+	return batch[:0]
+}
+
+func (rec *Recorder) hashIP(ip string) string {
+	if ip == "" {
+		return ""
+	}
+	h := sha256.New()
+	h.Write(rec.salt)
+	h.Write([]byte(ip))
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// clientIP returns the address of the client that sent r.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,93 @@
+package urlshort
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// blockingSink holds every write until it is released.
+type blockingSink struct {
+	release chan struct{}
+	mu      sync.Mutex
+	hits    []Hit
+}
+
+func (s *blockingSink) RecordHits(hits []Hit) error {
+	<-s.release
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hits = append(s.hits, hits...)
+	return nil
+}
+
+func TestRecorderBatchesHits(t *testing.T) {
+	store := NewMemoryStore([]Link{{Path: "/a", URL: "https://a.example"}})
+	sink := &blockingSink{release: make(chan struct{})}
+	close(sink.release)
+	rec := NewRecorder(sink, RecorderConfig{BatchSize: 2})
+	h, err := Handler(store, http.HandlerFunc(fallback), WithRecorder(rec))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/a", nil)
+	req.Header.Set("Referer", "https://news.example")
+	req.Header.Set("User-Agent", "test-agent")
+	for i := 0; i < 3; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	serve(h, "/missing")
+	rec.Close()
+
+	if len(sink.hits) != 3 {
+		t.Fatalf("stored %d hits, want 3", len(sink.hits))
+	}
+	hit := sink.hits[0]
+	if hit.Path != "/a" || hit.Referrer != "https://news.example" || hit.UserAgent != "test-agent" || hit.IPHash == "" {
+		t.Errorf("hit = %+v", hit)
+	}
+	if rec.Recorded() != 3 || rec.Dropped() != 0 {
+		t.Errorf("recorded %d, dropped %d", rec.Recorded(), rec.Dropped())
+	}
+}
+
+func TestRecorderDropsWhenFull(t *testing.T) {
+	sink := &blockingSink{release: make(chan struct{})}
+	rec := NewRecorder(sink, RecorderConfig{Buffer: 2, BatchSize: 1})
+	req := httptest.NewRequest(http.MethodGet, "/a", nil)
+
+	// The first hit is taken by the writer, which then blocks;
+	// two more fill the queue and the rest are dropped.
+	rec.Record("/a", req)
+	waitFor(t, func() bool { return len(rec.hits) == 0 })
+	for i := 0; i < 5; i++ {
+		rec.Record("/a", req)
+	}
+	if rec.Dropped() != 3 {
+		t.Errorf("Dropped() = %d, want 3", rec.Dropped())
+	}
+	close(sink.release)
+	rec.Close()
+	if len(sink.hits) != 3 {
+		t.Errorf("stored %d hits, want 3", len(sink.hits))
+	}
+}
+
+type failingSink struct{}
+
+func (failingSink) RecordHits([]Hit) error { return errors.New("disk full") }
+
+func TestRecorderCountsFailures(t *testing.T) {
+	rec := NewRecorder(failingSink{}, RecorderConfig{Logger: log.New(ioutil.Discard, "", 0)})
+	rec.Record("/a", httptest.NewRequest(http.MethodGet, "/a", nil))
+	rec.Flush()
+	if rec.Failed() != 1 {
+		t.Errorf("Failed() = %d, want 1", rec.Failed())
+	}
+	rec.Close()
+}
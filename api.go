@@ -0,0 +1,662 @@
+package urlshort
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIPrefix is the path the admin API is served under.
+const APIPrefix = "/api/v1/links"
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+)
+
+// API is an http.Handler serving a JSON API to manage the links
+// in a Store:
+//
+//     POST   /api/v1/links         create a link
+//     GET    /api/v1/links         list links, see below
+//     GET    /api/v1/links/{code}  get one link
+//     PATCH  /api/v1/links/{code}  update some fields of a link
+//     DELETE /api/v1/links/{code}  delete a link
+//     GET    /api/v1/links/{code}/stats     hit statistics, see below
+//     GET    /api/v1/links/{code}/visitors  distinct visitors by day
+//
+// {code} is the link's path without its leading slash, escaped
+// as a single path segment, so /gh/* is addressed as gh%2F*.
+// A link created without a path gets a generated code, and
+// paths whose first segment is a reserved word are refused.
+// With Dedupe set, creating a link without a path for a URL the
+// same owner already shortened returns the existing link with
+// 200 OK instead. Only links without a password, click limit,
+// expiry, status or query policy are deduplicated, on both
+// sides.
+// Create requests may also be HTML forms with host, path, url
+// and token fields, as posted from the page of SuggestHandler;
+// they are answered with a redirect to the new link.
+// A PATCH request changes the fields it gives; an expires_at of
+// null removes the link's expiry.
+// Lists are paginated with the limit (default 50, at most 1000)
+// and offset query parameters.
+//
+// Links of a host are addressed with the host query parameter,
+// as in /api/v1/links/docs?host=go.corp. Given to a list request,
+// it restricts the list to the links of that host; an empty host
+// stands for the default domain.
+//
+// Statistics need a store implementing StatsStore, such as a
+// BoltStore; with others they answer 501 Not Implemented. They
+// cover the range given by the from and to query parameters,
+// as RFC 3339 times or dates, split by interval, hour or day
+// (the default). The range defaults to the last 24 hours by
+// hour and the last 30 days by day. Distinct visitors are
+// estimated by day, over the last 30 days by default.
+//
+// The API can change every link, so it must not be reachable
+// by everyone: serve it on an address of its own, or set Token.
+//
+// Errors are reported with a 4xx or 5xx status and a body of the
+// form {"error": "..."}.
+type API struct {
+	// Codes makes the codes of links created without a path
+	// and decides which words are reserved.
+	Codes *CodeGenerator
+	// Dedupe enables deduplication of links created without a
+	// path. It needs a store implementing URLIndex.
+	Dedupe bool
+	// Token, if not empty, must be sent with every request, as
+	// a bearer token in the Authorization header, or in the
+	// token field of a form.
+	Token string
+
+	store Store
+	table *Table
+
+	mu sync.Mutex // serialises writes
+}
+
+// NewAPI returns an API managing the links in store. If table
+// is not nil, every change is applied to it as well, so the
+// handler serving it redirects new links right away. Codes are
+// random until a different CodeGenerator is set.
+func NewAPI(store Store, table *Table) *API {
+	return &API{Codes: &CodeGenerator{}, store: store, table: table}
+}
+
+// linkPage is the response to a list request.
+type linkPage struct {
+	Links  []Link `json:"links"`
+	Total  int    `json:"total"`
+	Offset int    `json:"offset"`
+	Limit  int    `json:"limit"`
+}
+
+// linkRequest is the body of a create request: a link, plus a
+// password in clear text to protect it with.
+type linkRequest struct {
+	Link
+	Password string `json:"password"`
+}
+
+// linkPatch holds the fields a PATCH request may change. Fields
+// left out of the request are nil and keep their value.
+type linkPatch struct {
+	URL    *string      `json:"url"`
+	Query  *QueryPolicy `json:"query"`
+	Status *int         `json:"status"`
+	// ExpiresAt is kept raw, so that null, which removes the
+	// expiry, can be told apart from a missing field.
+	ExpiresAt json.RawMessage `json:"expires_at"`
+	TTL       *string         `json:"ttl"`
+	MaxClicks *int            `json:"max_clicks"`
+	// Password replaces the link's password; an empty one
+	// removes the protection.
+	Password *string `json:"password"`
+}
+
+// apiError is an error with the HTTP status to report it with.
+type apiError struct {
+	status int
+	msg    string
+}
+
+func (e *apiError) Error() string { return e.msg }
+
+func errorf(status int, format string, args ...interface{}) error {
+	return &apiError{status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		v   interface{}
+		err error
+	)
+	status := http.StatusOK
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="urlshort"`)
+		writeError(w, errorf(http.StatusUnauthorized, "missing or invalid token"))
+		return
+	}
+	rest := strings.TrimPrefix(r.URL.EscapedPath(), APIPrefix)
+	switch {
+	case rest == "" || rest == "/":
+		switch r.Method {
+		case http.MethodGet:
+			v, err = a.list(r)
+		case http.MethodPost:
+			var created bool
+			v, created, err = a.create(r)
+			if err == nil && isForm(r) {
+				// Sent from a suggestion page: show the visitor
+				// the link at work.
+				http.Redirect(w, r, v.(Link).Path, http.StatusSeeOther)
+				return
+			}
+			if created {
+				status = http.StatusCreated
+			}
+		default:
+			err = methodNotAllowed(w, "GET, POST")
+		}
+	case strings.HasPrefix(rest, "/") && !strings.Contains(rest[1:], "/"):
+		var key string
+		key, err = linkKey(rest[1:], r)
+		if err != nil {
+			break
+		}
+		switch r.Method {
+		case http.MethodGet:
+			v, err = a.store.Lookup(key)
+		case http.MethodPatch:
+			v, err = a.update(key, r)
+		case http.MethodDelete:
+			err = a.delete(key)
+			status = http.StatusNoContent
+		default:
+			err = methodNotAllowed(w, "GET, PATCH, DELETE")
+		}
+	case strings.HasPrefix(rest, "/") && strings.Count(rest, "/") == 2:
+		i := strings.LastIndexByte(rest, '/')
+		var key string
+		key, err = linkKey(rest[1:i], r)
+		if err != nil {
+			break
+		}
+		var get func(string, *http.Request) (interface{}, error)
+		switch rest[i+1:] {
+		case "stats":
+			get = a.stats
+		case "visitors":
+			get = a.visitors
+		default:
+			err = errorf(http.StatusNotFound, "no such endpoint")
+		}
+		if err != nil {
+			break
+		}
+		if r.Method != http.MethodGet {
+			err = methodNotAllowed(w, "GET")
+			break
+		}
+		v, err = get(key, r)
+	default:
+		err = errorf(http.StatusNotFound, "no such endpoint")
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, status, redact(v))
+}
+
+// redact hides password hashes from API responses.
+func redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case Link:
+		v.PasswordHash = ""
+		return v
+	case linkPage:
+		links := make([]Link, len(v.Links))
+		for i, l := range v.Links {
+			l.PasswordHash = ""
+			links[i] = l
+		}
+		v.Links = links
+		return v
+	}
+	return v
+}
+
+func (a *API) list(r *http.Request) (interface{}, error) {
+	q := r.URL.Query()
+	limit, err := intParam(q, "limit", defaultPageSize)
+	if err != nil {
+		return nil, err
+	}
+	if limit < 1 || limit > maxPageSize {
+		return nil, errorf(http.StatusBadRequest, "limit must be between 1 and %d", maxPageSize)
+	}
+	offset, err := intParam(q, "offset", 0)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 {
+		return nil, errorf(http.StatusBadRequest, "offset must not be negative")
+	}
+
+	links, err := a.store.List()
+	if err != nil {
+		return nil, err
+	}
+	if hosts, ok := q["host"]; ok {
+		all := links
+		links = nil
+		for _, l := range all {
+			if l.Host == hosts[0] {
+				links = append(links, l)
+			}
+		}
+	}
+	page := linkPage{Links: []Link{}, Total: len(links), Offset: offset, Limit: limit}
+	if offset < len(links) {
+		end := offset + limit
+		if end > len(links) {
+			end = len(links)
+		}
+		page.Links = links[offset:end]
+	}
+	return page, nil
+}
+
+// create stores the link in the request body. It reports
+// whether a new link was created, rather than an existing one
+// returned by deduplication.
+func (a *API) create(r *http.Request) (Link, bool, error) {
+	var req linkRequest
+	if isForm(r) {
+		if !sameOrigin(r) {
+			return Link{}, false, errorf(http.StatusForbidden, "form posted from another site")
+		}
+		req.Host, req.Path, req.URL = r.PostFormValue("host"), r.PostFormValue("path"), r.PostFormValue("url")
+	} else if err := decodeBody(r, &req); err != nil {
+		return Link{}, false, err
+	}
+	l := req.Link
+	if err := resolveTTL(&l, time.Now()); err != nil {
+		return Link{}, false, errorf(http.StatusBadRequest, "%v", err)
+	}
+	l.Clicks = 0
+	if req.Password != "" {
+		h, err := HashPassword(req.Password)
+		if err != nil {
+			return Link{}, false, err
+		}
+		l.PasswordHash = h
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if l.Path == "" {
+		if idx, ok := a.store.(URLIndex); ok && a.Dedupe && plain(l) {
+			existing, err := idx.LookupURL(l.Owner, l.Host, l.URL)
+			if err == nil && plain(existing) {
+				return existing, false, nil
+			}
+			if err != nil && err != ErrNotFound {
+				return Link{}, false, err
+			}
+		}
+		path, err := a.Codes.GenerateFor(a.store, l.Host, l.URL)
+		if err != nil {
+			return Link{}, false, err
+		}
+		l.Path = path
+	} else if a.Codes.reserved(firstSegment(l.Path)) {
+		return Link{}, false, errorf(http.StatusBadRequest, "path %s is reserved", l.Path)
+	}
+	if err := a.checkLink(l); err != nil {
+		return Link{}, false, err
+	}
+	_, err := a.store.Lookup(l.Key())
+	switch err {
+	case nil:
+		return Link{}, false, errorf(http.StatusConflict, "a link for %s already exists", l.Key())
+	case ErrNotFound:
+	default:
+		return Link{}, false, err
+	}
+	if _, err := a.save(l, nil); err != nil {
+		return Link{}, false, err
+	}
+	return l, true, nil
+}
+
+// plain reports whether l redirects to its URL with none of
+// the settings a link can have of its own, so that deduplication
+// may hand it out for any other plain link to the same URL.
+func plain(l Link) bool {
+	return l.PasswordHash == "" && l.MaxClicks == 0 && l.ExpiresAt == nil && l.Status == 0 && l.Query == ""
+}
+
+func (a *API) update(key string, r *http.Request) (interface{}, error) {
+	var p linkPatch
+	if err := decodeBody(r, &p); err != nil {
+		return nil, err
+	}
+	change, err := p.change(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	l, err := a.store.Lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := change(&l); err != nil {
+		return nil, err
+	}
+	if err := a.checkLink(l); err != nil {
+		return nil, err
+	}
+	// Apply the change to the link as stored when writing it, so
+	// clicks consumed since the lookup are not handed back.
+	write := func() (Link, error) { return l, a.store.Put(l) }
+	if u, ok := a.store.(Updater); ok {
+		write = func() (Link, error) { return u.Update(key, change) }
+	}
+	return a.save(l, write)
+}
+
+// change returns a function applying p to a link. The password
+// is hashed, and the TTL counted from now, once and for all.
+func (p linkPatch) change(now time.Time) (func(*Link) error, error) {
+	var hash string
+	if p.Password != nil && *p.Password != "" {
+		var err error
+		if hash, err = HashPassword(*p.Password); err != nil {
+			return nil, err
+		}
+	}
+	var expires *time.Time
+	if p.ExpiresAt != nil {
+		if err := json.Unmarshal(p.ExpiresAt, &expires); err != nil {
+			return nil, errorf(http.StatusBadRequest, "invalid expires_at: %v", err)
+		}
+	}
+	var ttl Link
+	if p.TTL != nil {
+		ttl.TTL = *p.TTL
+		if err := resolveTTL(&ttl, now); err != nil {
+			return nil, errorf(http.StatusBadRequest, "%v", err)
+		}
+	}
+	return func(l *Link) error {
+		if p.URL != nil {
+			l.URL = *p.URL
+		}
+		if p.Query != nil {
+			l.Query = *p.Query
+		}
+		if p.Status != nil {
+			l.Status = *p.Status
+		}
+		if p.ExpiresAt != nil {
+			l.ExpiresAt = expires
+		}
+		if p.MaxClicks != nil {
+			l.MaxClicks = *p.MaxClicks
+		}
+		if p.Password != nil {
+			l.PasswordHash = hash
+		}
+		if p.TTL != nil {
+			l.TTL, l.ExpiresAt = ttl.TTL, ttl.ExpiresAt
+		}
+		return nil
+	}, nil
+}
+
+func (a *API) stats(key string, r *http.Request) (interface{}, error) {
+	q := r.URL.Query()
+	iv := Interval(q.Get("interval"))
+	if iv == "" {
+		iv = Daily
+	}
+	if iv.check() != nil {
+		return nil, errorf(http.StatusBadRequest, "interval must be hour or day")
+	}
+	ss, from, to, err := a.statsQuery(key, q, iv)
+	if err != nil {
+		return nil, err
+	}
+	return LinkStats(ss, key, iv, from, to)
+}
+
+func (a *API) visitors(key string, r *http.Request) (interface{}, error) {
+	ss, from, to, err := a.statsQuery(key, r.URL.Query(), Daily)
+	if err != nil {
+		return nil, err
+	}
+	return LinkVisitors(ss, key, from, to)
+}
+
+// statsQuery checks a statistics request on the link stored
+// under key by iv, and returns the store to query and the
+// range requested.
+func (a *API) statsQuery(key string, q url.Values, iv Interval) (ss StatsStore, from, to time.Time, err error) {
+	ss, ok := a.store.(StatsStore)
+	if !ok {
+		return nil, from, to, errorf(http.StatusNotImplemented, "the store does not keep statistics")
+	}
+	if to, err = timeParam(q, "to", time.Now()); err != nil {
+		return nil, from, to, err
+	}
+	from = to.AddDate(0, 0, -30)
+	if iv == Hourly {
+		from = to.Add(-24 * time.Hour)
+	}
+	if from, err = timeParam(q, "from", from); err != nil {
+		return nil, from, to, err
+	}
+	if _, err := emptyStats(key, iv, from, to); err != nil {
+		return nil, from, to, errorf(http.StatusBadRequest, "%v", err)
+	}
+	if _, err := a.store.Lookup(key); err != nil {
+		return nil, from, to, err
+	}
+	return ss, from, to, nil
+}
+
+func (a *API) delete(key string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.store.Delete(key); err != nil {
+		return err
+	}
+	if a.table != nil {
+		if err := a.table.Remove(key); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// save writes l to the store, with write if it is not nil, and
+// to the table, and returns the link as stored. a.mu must be
+// held.
+func (a *API) save(l Link, write func() (Link, error)) (Link, error) {
+	if a.table != nil {
+		// Refuse links conflicting with those of the table
+		// before the store has them.
+		if err := a.table.check(l); err != nil {
+			return Link{}, errorf(http.StatusConflict, "%v", err)
+		}
+	}
+	if write == nil {
+		write = func() (Link, error) { return l, a.store.Put(l) }
+	}
+	l, err := write()
+	if err != nil {
+		return Link{}, err
+	}
+	if a.table != nil {
+		return l, a.table.Add(l)
+	}
+	return l, nil
+}
+
+// checkLink reports why l cannot be stored, if it cannot. Its
+// URL must follow the target policy of the table.
+func (a *API) checkLink(l Link) error {
+	var targets *TargetPolicy
+	if a.table != nil {
+		targets = a.table.rules().targets
+	}
+	if _, err := newRule(l, targets); err != nil {
+		return errorf(http.StatusBadRequest, "%v", err)
+	}
+	return nil
+}
+
+// firstSegment returns the first segment of path.
+func firstSegment(path string) string {
+	path = strings.TrimPrefix(path, "/")
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		path = path[:i]
+	}
+	return path
+}
+
+// codePath returns the link path addressed by an escaped {code}
+// segment.
+func codePath(code string) (string, error) {
+	s, err := url.PathUnescape(code)
+	if err != nil || s == "" {
+		return "", errorf(http.StatusBadRequest, "invalid link code %q", code)
+	}
+	return "/" + s, nil
+}
+
+// linkKey returns the key of the link addressed by an escaped
+// {code} segment and the host query parameter of r.
+func linkKey(code string, r *http.Request) (string, error) {
+	path, err := codePath(code)
+	if err != nil {
+		return "", err
+	}
+	host := r.URL.Query().Get("host")
+	if err := checkHost(host); err != nil {
+		return "", errorf(http.StatusBadRequest, "%v", err)
+	}
+	return Link{Host: host, Path: path}.Key(), nil
+}
+
+// authorized reports whether r carries a.Token, if it is set.
+func (a *API) authorized(r *http.Request) bool {
+	if a.Token == "" {
+		return true
+	}
+	var token string
+	if r.Method == http.MethodPost && isForm(r) {
+		token = r.PostFormValue("token")
+	} else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = auth[len("Bearer "):]
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1
+}
+
+// isForm reports whether r carries an HTML form rather than
+// JSON.
+func isForm(r *http.Request) bool {
+	t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return t == "application/x-www-form-urlencoded"
+}
+
+// sameOrigin reports whether a form was posted from a page of
+// the server it is posted to. Browsers send the Origin header
+// with every POST, so other sites cannot create links on behalf
+// of their visitors; forms without one are refused.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+func decodeBody(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return errorf(http.StatusBadRequest, "invalid request body: %v", err)
+	}
+	return nil
+}
+
+func intParam(q url.Values, name string, def int) (int, error) {
+	s := q.Get(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errorf(http.StatusBadRequest, "%s must be an integer", name)
+	}
+	return n, nil
+}
+
+// timeParam parses a time given as RFC 3339 or as a date.
+func timeParam(q url.Values, name string, def time.Time) (time.Time, error) {
+	s := q.Get(name)
+	if s == "" {
+		return def, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, errorf(http.StatusBadRequest, "%s must be an RFC 3339 time or a date", name)
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) error {
+	w.Header().Set("Allow", allow)
+	return errorf(http.StatusMethodNotAllowed, "method not allowed")
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var ae *apiError
+	switch {
+	case errors.As(err, &ae):
+		status = ae.status
+	case err == ErrNotFound:
+		status = http.StatusNotFound
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,207 @@
+package urlshort
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func apiRequest(t *testing.T, h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return rec
+}
+
+func assertCode(t *testing.T, rec *httptest.ResponseRecorder, code int) {
+	t.Helper()
+	if rec.Code != code {
+		t.Fatalf("status = %d, want %d (body %s)", rec.Code, code, rec.Body)
+	}
+}
+
+func TestAPI(t *testing.T) {
+	store := NewMemoryStore(nil)
+	table, err := LoadTable(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := NewAPI(store, table)
+	h, err := TableHandler(table, http.HandlerFunc(fallback))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := apiRequest(t, api, "POST", "/api/v1/links", `{"path": "/docs", "url": "https://docs.example"}`)
+	assertCode(t, rec, http.StatusCreated)
+	assertRedirect(t, serve(h, "/docs"), http.StatusFound, "https://docs.example")
+
+	assertCode(t, apiRequest(t, api, "POST", "/api/v1/links", `{"path": "/docs", "url": "https://other.example"}`), http.StatusConflict)
+	assertCode(t, apiRequest(t, api, "POST", "/api/v1/links", `{"path": "/x", "url": "not a url"}`), http.StatusBadRequest)
+	assertCode(t, apiRequest(t, api, "POST", "/api/v1/links", `{"path": "x", "url": "https://x.example"}`), http.StatusBadRequest)
+	assertCode(t, apiRequest(t, api, "POST", "/api/v1/links", `{"path": "/x", "url": "https://x.example", "status": 200}`), http.StatusBadRequest)
+	assertCode(t, apiRequest(t, api, "POST", "/api/v1/links", `{"path": "/x", "uri": "https://x.example"}`), http.StatusBadRequest)
+
+	rec = apiRequest(t, api, "POST", "/api/v1/links", `{"path": "/gh/*", "url": "https://github.com/{rest}"}`)
+	assertCode(t, rec, http.StatusCreated)
+
+	rec = apiRequest(t, api, "GET", "/api/v1/links/gh%2F*", "")
+	assertCode(t, rec, http.StatusOK)
+	var l Link
+	if err := json.NewDecoder(rec.Body).Decode(&l); err != nil || l.URL != "https://github.com/{rest}" {
+		t.Errorf("GET one = %+v, %v", l, err)
+	}
+
+	rec = apiRequest(t, api, "GET", "/api/v1/links?limit=1&offset=1", "")
+	assertCode(t, rec, http.StatusOK)
+	var page linkPage
+	if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 2 || len(page.Links) != 1 || page.Links[0].Path != "/gh/*" {
+		t.Errorf("page = %+v", page)
+	}
+	assertCode(t, apiRequest(t, api, "GET", "/api/v1/links?limit=0", ""), http.StatusBadRequest)
+
+	rec = apiRequest(t, api, "PATCH", "/api/v1/links/docs", `{"url": "https://docs2.example", "status": 301}`)
+	assertCode(t, rec, http.StatusOK)
+	assertRedirect(t, serve(h, "/docs"), http.StatusMovedPermanently, "https://docs2.example")
+	assertCode(t, apiRequest(t, api, "PATCH", "/api/v1/links/docs", `{"url": "ftp:"}`), http.StatusBadRequest)
+	assertCode(t, apiRequest(t, api, "PATCH", "/api/v1/links/nope", `{"url": "https://x.example"}`), http.StatusNotFound)
+
+	// An expiry is set with a time and removed with null; leaving
+	// the field out keeps it.
+	assertCode(t, apiRequest(t, api, "PATCH", "/api/v1/links/docs", `{"expires_at": "2030-01-31T23:59:59Z"}`), http.StatusOK)
+	assertCode(t, apiRequest(t, api, "PATCH", "/api/v1/links/docs", `{"status": 302}`), http.StatusOK)
+	if l, _ := store.Lookup("/docs"); l.ExpiresAt == nil || l.ExpiresAt.Year() != 2030 {
+		t.Errorf("expiry not kept: %+v", l)
+	}
+	assertCode(t, apiRequest(t, api, "PATCH", "/api/v1/links/docs", `{"expires_at": null}`), http.StatusOK)
+	if l, _ := store.Lookup("/docs"); l.ExpiresAt != nil {
+		t.Errorf("expiry not removed: %+v", l)
+	}
+	assertCode(t, apiRequest(t, api, "PATCH", "/api/v1/links/docs", `{"expires_at": "soon"}`), http.StatusBadRequest)
+
+	assertCode(t, apiRequest(t, api, "DELETE", "/api/v1/links/docs", ""), http.StatusNoContent)
+	assertCode(t, apiRequest(t, api, "DELETE", "/api/v1/links/docs", ""), http.StatusNotFound)
+	assertCode(t, apiRequest(t, api, "GET", "/api/v1/links/docs", ""), http.StatusNotFound)
+	assertFallback(t, serve(h, "/docs"))
+
+	assertCode(t, apiRequest(t, api, "PUT", "/api/v1/links", ""), http.StatusMethodNotAllowed)
+	assertCode(t, apiRequest(t, api, "GET", "/api/v1/links/a/b", ""), http.StatusNotFound)
+}
+
+func TestAPIToken(t *testing.T) {
+	store := NewMemoryStore([]Link{{Path: "/docs", URL: "https://docs.example"}})
+	api := NewAPI(store, nil)
+	api.Token = "s3cret"
+	send := func(method, body, auth string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api/v1/links/docs", strings.NewReader(body))
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, r)
+		return rec
+	}
+	rec := send("DELETE", "", "")
+	assertCode(t, rec, http.StatusUnauthorized)
+	if rec.Header().Get("WWW-Authenticate") == "" {
+		t.Error("no WWW-Authenticate header")
+	}
+	assertCode(t, send("PATCH", `{"url": "https://evil.example"}`, "Bearer wrong"), http.StatusUnauthorized)
+	assertCode(t, send("GET", "", "Basic s3cret"), http.StatusUnauthorized)
+	assertCode(t, send("GET", "", "Bearer s3cret"), http.StatusOK)
+
+	// Forms carry the token in a field, and must come from the
+	// server's own pages.
+	post := func(token, origin string) *httptest.ResponseRecorder {
+		form := url.Values{"path": {"/new"}, "url": {"https://new.example"}, "token": {token}}
+		r := httptest.NewRequest(http.MethodPost, "http://example.org"+APIPrefix, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, r)
+		return rec
+	}
+	assertCode(t, post("wrong", "http://example.org"), http.StatusUnauthorized)
+	assertCode(t, post("s3cret", ""), http.StatusForbidden)
+	assertCode(t, post("s3cret", "http://example.org"), http.StatusSeeOther)
+	if _, err := store.Lookup("/new"); err != nil {
+		t.Errorf("link not created: %v", err)
+	}
+}
+
+func TestAPIGeneratesCodes(t *testing.T) {
+	store := NewMemoryStore(nil)
+	api := NewAPI(store, nil)
+	api.Codes = &CodeGenerator{Strategy: CodeSequential, MinLength: 3}
+
+	rec := apiRequest(t, api, "POST", "/api/v1/links", `{"url": "https://docs.example"}`)
+	assertCode(t, rec, http.StatusCreated)
+	var l Link
+	if err := json.NewDecoder(rec.Body).Decode(&l); err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Path) != 4 {
+		t.Errorf("generated path = %q, want 3 characters", l.Path)
+	}
+	if _, err := store.Lookup(l.Path); err != nil {
+		t.Errorf("generated link not stored: %v", err)
+	}
+
+	assertCode(t, apiRequest(t, api, "POST", "/api/v1/links", `{"path": "/admin/x", "url": "https://x.example"}`), http.StatusBadRequest)
+}
+
+func TestAPIDedupe(t *testing.T) {
+	store := NewMemoryStore(nil)
+	api := NewAPI(store, nil)
+	api.Dedupe = true
+
+	rec := apiRequest(t, api, "POST", "/api/v1/links", `{"url": "https://ci.example/artifact?b=1&a=2", "owner": "ci"}`)
+	assertCode(t, rec, http.StatusCreated)
+	var first Link
+	json.NewDecoder(rec.Body).Decode(&first)
+
+	rec = apiRequest(t, api, "POST", "/api/v1/links", `{"url": "https://CI.example:443/artifact/?a=2&b=1", "owner": "ci"}`)
+	assertCode(t, rec, http.StatusOK)
+	var again Link
+	json.NewDecoder(rec.Body).Decode(&again)
+	if again.Path != first.Path {
+		t.Errorf("dedupe returned %s, want %s", again.Path, first.Path)
+	}
+
+	rec = apiRequest(t, api, "POST", "/api/v1/links", `{"url": "https://ci.example/artifact?b=1&a=2", "owner": "dev"}`)
+	assertCode(t, rec, http.StatusCreated)
+
+	// Links with settings of their own are neither handed out
+	// nor replaced by deduplication.
+	rec = apiRequest(t, api, "POST", "/api/v1/links", `{"url": "https://ci.example/artifact?b=1&a=2", "owner": "ci", "password": "hunter2", "max_clicks": 1}`)
+	assertCode(t, rec, http.StatusCreated)
+	var locked Link
+	json.NewDecoder(rec.Body).Decode(&locked)
+	if l, _ := store.Lookup(locked.Path); locked.Path == first.Path || l.PasswordHash == "" || l.MaxClicks != 1 {
+		t.Errorf("protected create returned %+v", locked)
+	}
+	for _, body := range []string{
+		`{"url": "https://ci.example/artifact?b=1&a=2", "owner": "ci", "status": 301}`,
+		`{"url": "https://ci.example/artifact?b=1&a=2", "owner": "ci", "ttl": "1h"}`,
+		`{"url": "https://ci.example/artifact?b=1&a=2", "owner": "ci", "query": "drop"}`,
+	} {
+		assertCode(t, apiRequest(t, api, "POST", "/api/v1/links", body), http.StatusCreated)
+	}
+	rec = apiRequest(t, api, "POST", "/api/v1/links", `{"url": "https://open.example", "owner": "ci", "password": "hunter2"}`)
+	assertCode(t, rec, http.StatusCreated)
+	rec = apiRequest(t, api, "POST", "/api/v1/links", `{"url": "https://open.example", "owner": "ci"}`)
+	assertCode(t, rec, http.StatusCreated)
+	var open Link
+	json.NewDecoder(rec.Body).Decode(&open)
+	if l, _ := store.Lookup(open.Path); l.PasswordHash != "" {
+		t.Errorf("plain create returned a protected link: %+v", open)
+	}
+}
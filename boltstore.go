@@ -0,0 +1,450 @@
+package urlshort
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// pathsBucket is the bucket the links of the default domain
+	// are kept in, keyed by path.
+	pathsBucket = []byte("paths")
+	// hostsBucket holds a bucket per host, keeping its links
+	// keyed by path.
+	hostsBucket = []byte("hosts")
+	// urlsBucket is the reverse index behind LookupURL. Its keys
+	// are urlKey(link) + "\x00" + link.Key(), with empty values.
+	urlsBucket = []byte("urls")
+	// hitsBucket keeps hits as JSON documents, keyed by link key,
+	// a zero byte, the time in nanoseconds and a sequence number.
+	// Those older than hitRetention are pruned as hits come in.
+	hitsBucket = []byte("hits")
+	// statsBucket holds a bucket of rollups per link key. Their
+	// keys are the interval's first letter followed by the start
+	// of the interval in Unix seconds, big endian, so a range of
+	// rollups is a range of keys.
+	statsBucket = []byte("stats")
+)
+
+// BoltStore is a Store backed by a BoltDB database. Links are
+// kept as JSON documents keyed by path, in the "paths" bucket
+// for the default domain and in a bucket per host otherwise.
+// Plain URL values, as written by earlier versions of this
+// package, are still understood. BoltStore implements URLIndex,
+// ClickCounter, Updater, HitStore and StatsStore, keeping every
+// rollup but only the last 30 days of hits of each link.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore opens (creating if needed) the database at path.
+func OpenBoltStore(path string, mode os.FileMode) (*BoltStore, error) {
+	db, err := bolt.Open(path, mode, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewBoltStore(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewBoltStore returns a BoltStore using an already opened
+// database, creating the buckets it needs.
+func NewBoltStore(db *bolt.DB) (*BoltStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		paths, err := tx.CreateBucketIfNotExists(pathsBucket)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(hostsBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(hitsBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(statsBucket); err != nil {
+			return err
+		}
+		if tx.Bucket(urlsBucket) != nil {
+			return nil
+		}
+		// Build the reverse index of a database created before
+		// it existed.
+		urls, err := tx.CreateBucket(urlsBucket)
+		if err != nil {
+			return err
+		}
+		return paths.ForEach(func(k, v []byte) error {
+			l, err := decodeLink("", string(k), v)
+			if err != nil {
+				return err
+			}
+			return indexLink(urls, l)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+// DB returns the underlying database.
+func (s *BoltStore) DB() *bolt.DB {
+	return s.db
+}
+
+// Close closes the underlying database.
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// Lookup implements Store.
+func (s *BoltStore) Lookup(key string) (Link, error) {
+	var l Link
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		l, err = getLink(tx, key)
+		return err
+	})
+	return l, err
+}
+
+// Put implements Store.
+func (s *BoltStore) Put(link Link) error {
+	v, err := json.Marshal(link)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := unindexKey(tx, link.Key()); err != nil {
+			return err
+		}
+		b, err := createLinkBucket(tx, link.Host)
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(link.Path), v); err != nil {
+			return err
+		}
+		return indexLink(tx.Bucket(urlsBucket), link)
+	})
+}
+
+// Delete implements Store.
+func (s *BoltStore) Delete(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		host, path := splitKey(key)
+		b := linkBucket(tx, host)
+		if b == nil || b.Get([]byte(path)) == nil {
+			return ErrNotFound
+		}
+		if err := unindexKey(tx, key); err != nil {
+			return err
+		}
+		return b.Delete([]byte(path))
+	})
+}
+
+// List implements Store. Bolt iterates keys in byte order, so
+// the result is already sorted by host and path.
+func (s *BoltStore) List() ([]Link, error) {
+	var links []Link
+	err := s.db.View(func(tx *bolt.Tx) error {
+		list := func(host string, b *bolt.Bucket) error {
+			return b.ForEach(func(k, v []byte) error {
+				l, err := decodeLink(host, string(k), v)
+				if err != nil {
+					return err
+				}
+				links = append(links, l)
+				return nil
+			})
+		}
+		if err := list("", tx.Bucket(pathsBucket)); err != nil {
+			return err
+		}
+		hosts := tx.Bucket(hostsBucket)
+		return hosts.ForEach(func(k, _ []byte) error {
+			return list(string(k), hosts.Bucket(k))
+		})
+	})
+	return links, err
+}
+
+// Consume implements ClickCounter. The check and the update
+// happen in a single read-write transaction.
+func (s *BoltStore) Consume(key string) (Link, error) {
+	var l Link
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if l, err = getLink(tx, key); err != nil {
+			return err
+		}
+		if err := consume(&l); err != nil {
+			return err
+		}
+		v, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		return linkBucket(tx, l.Host).Put([]byte(l.Path), v)
+	})
+	return l, err
+}
+
+// Update implements Updater. The link is read and written in a
+// single read-write transaction.
+func (s *BoltStore) Update(key string, change func(*Link) error) (Link, error) {
+	var l Link
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if l, err = getLink(tx, key); err != nil {
+			return err
+		}
+		if err := change(&l); err != nil {
+			return err
+		}
+		v, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		if err := unindexKey(tx, key); err != nil {
+			return err
+		}
+		if err := linkBucket(tx, l.Host).Put([]byte(l.Path), v); err != nil {
+			return err
+		}
+		return indexLink(tx.Bucket(urlsBucket), l)
+	})
+	if err != nil {
+		return Link{}, err
+	}
+	return l, nil
+}
+
+// hitRetention is how long a BoltStore keeps raw hits, counted
+// back from the latest hit of their link. Rollups are kept for
+// good.
+const hitRetention = 30 * 24 * time.Hour
+
+// RecordHits implements HitStore. The whole batch, and the
+// rollups it updates, are written in a single transaction.
+func (s *BoltStore) RecordHits(hits []Hit) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(hitsBucket)
+		latest := make(map[string]time.Time)
+		for _, h := range hits {
+			if h.Time.After(latest[h.Path]) {
+				latest[h.Path] = h.Time
+			}
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			v, err := json.Marshal(h)
+			if err != nil {
+				return err
+			}
+			key := make([]byte, len(h.Path)+17)
+			copy(key, h.Path)
+			binary.BigEndian.PutUint64(key[len(h.Path)+1:], uint64(h.Time.UnixNano()))
+			binary.BigEndian.PutUint64(key[len(h.Path)+9:], seq)
+			if err := b.Put(key, v); err != nil {
+				return err
+			}
+		}
+		for path, t := range latest {
+			if err := pruneHits(b, path, t.Add(-hitRetention)); err != nil {
+				return err
+			}
+		}
+		for path, rs := range rollupHits(hits) {
+			if err := mergeRollups(tx, path, rs); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// pruneHits deletes the hits of path from b that are older than
+// before.
+func pruneHits(b *bolt.Bucket, path string, before time.Time) error {
+	prefix := append([]byte(path), 0)
+	limit := make([]byte, len(prefix)+8)
+	copy(limit, prefix)
+	binary.BigEndian.PutUint64(limit[len(prefix):], uint64(before.UnixNano()))
+	var old [][]byte
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.Compare(k, limit) < 0; k, _ = c.Next() {
+		old = append(old, append([]byte(nil), k...))
+	}
+	for _, k := range old {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeRollups adds rs to the rollups stored for path.
+func mergeRollups(tx *bolt.Tx, path string, rs map[period]*Rollup) error {
+	b, err := tx.Bucket(statsBucket).CreateBucketIfNotExists([]byte(path))
+	if err != nil {
+		return err
+	}
+	for p, r := range rs {
+		key := rollupKey(p.iv, p.start)
+		if v := b.Get(key); v != nil {
+			var old Rollup
+			if err := json.Unmarshal(v, &old); err != nil {
+				return err
+			}
+			old.merge(r)
+			r = &old
+		}
+		v, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(key, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func rollupKey(iv Interval, start int64) []byte {
+	key := make([]byte, 9)
+	key[0] = iv[0]
+	binary.BigEndian.PutUint64(key[1:], uint64(start))
+	return key
+}
+
+// Rollups implements StatsStore.
+func (s *BoltStore) Rollups(path string, iv Interval, from, to time.Time) ([]Rollup, error) {
+	var rollups []Rollup
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(statsBucket).Bucket([]byte(path))
+		if b == nil {
+			return nil
+		}
+		end := rollupKey(iv, to.Unix())
+		c := b.Cursor()
+		for k, v := c.Seek(rollupKey(iv, from.Unix())); k != nil && bytes.Compare(k, end) < 0; k, v = c.Next() {
+			var r Rollup
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			rollups = append(rollups, r)
+		}
+		return nil
+	})
+	return rollups, err
+}
+
+// LookupURL implements URLIndex. When several links qualify,
+// the one with the smallest key is returned.
+func (s *BoltStore) LookupURL(owner, host, rawurl string) (Link, error) {
+	key, ok := urlKey(Link{Path: "/", URL: rawurl, Owner: owner, Host: host})
+	if !ok {
+		return Link{}, ErrNotFound
+	}
+	prefix := []byte(key + "\x00")
+	now := time.Now()
+	var l Link
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(urlsBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			var err error
+			if l, err = getLink(tx, string(k[len(prefix):])); err != nil {
+				return err
+			}
+			if !l.Expired(now) && !l.exhausted() {
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
+	return l, err
+}
+
+func indexLink(urls *bolt.Bucket, l Link) error {
+	key, ok := urlKey(l)
+	if !ok {
+		return nil
+	}
+	return urls.Put([]byte(key+"\x00"+l.Key()), []byte{})
+}
+
+// unindexKey removes the link currently stored under key, if
+// any, from the reverse index.
+func unindexKey(tx *bolt.Tx, key string) error {
+	l, err := getLink(tx, key)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	uk, ok := urlKey(l)
+	if !ok {
+		return nil
+	}
+	return tx.Bucket(urlsBucket).Delete([]byte(uk + "\x00" + key))
+}
+
+// linkBucket returns the bucket holding the links of host, or
+// nil if it has none.
+func linkBucket(tx *bolt.Tx, host string) *bolt.Bucket {
+	if host == "" {
+		return tx.Bucket(pathsBucket)
+	}
+	return tx.Bucket(hostsBucket).Bucket([]byte(host))
+}
+
+// createLinkBucket is like linkBucket but creates the bucket of
+// host if needed.
+func createLinkBucket(tx *bolt.Tx, host string) (*bolt.Bucket, error) {
+	if host == "" {
+		return tx.Bucket(pathsBucket), nil
+	}
+	return tx.Bucket(hostsBucket).CreateBucketIfNotExists([]byte(host))
+}
+
+// getLink returns the link stored under key.
+func getLink(tx *bolt.Tx, key string) (Link, error) {
+	host, path := splitKey(key)
+	b := linkBucket(tx, host)
+	if b == nil {
+		return Link{}, ErrNotFound
+	}
+	v := b.Get([]byte(path))
+	if v == nil {
+		return Link{}, ErrNotFound
+	}
+	return decodeLink(host, path, v)
+}
+
+// decodeLink decodes the value stored for path in the bucket of
+// host. Values that are not JSON objects are taken to be bare
+// URLs.
+func decodeLink(host, path string, v []byte) (Link, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(v), []byte("{")) {
+		return Link{Path: path, URL: string(v), Host: host}, nil
+	}
+	var l Link
+	if err := json.Unmarshal(v, &l); err != nil {
+		return Link{}, err
+	}
+	l.Host, l.Path = host, path
+	return l, nil
+}
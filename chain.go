@@ -0,0 +1,196 @@
+package urlshort
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ChainMode decides what happens to links that redirect to
+// other links of the same server.
+type ChainMode string
+
+const (
+	// ChainReject refuses to load loops and chains longer than
+	// the policy allows.
+	ChainReject ChainMode = "reject"
+	// ChainWarn loads them, logging a warning for each.
+	ChainWarn ChainMode = "warn"
+	// ChainCollapse has links redirect straight to the end of
+	// their chain, skipping the links in between, which then
+	// neither count clicks nor record hits. Links with a
+	// password, a click limit, an expiry or a query policy of
+	// their own are never skipped; chains through them are
+	// checked as with ChainReject, and so are loops.
+	ChainCollapse ChainMode = "collapse"
+)
+
+// defaultMaxChain is the number of redirects a chain may take
+// when the policy does not say.
+const defaultMaxChain = 3
+
+// ChainPolicy enables the detection of links whose URL points
+// back to the server, at one of its own links. Following them,
+// visitors may go round in circles, or through several
+// redirects before reaching their destination.
+type ChainPolicy struct {
+	// Hosts lists the hosts the server answers to, besides the
+	// hosts of its links. As in Link.Host, "*.example.com"
+	// stands for the subdomains of example.com.
+	Hosts []string
+	// MaxDepth is the most redirects a visitor may be sent
+	// through, counting the first; zero means 3.
+	MaxDepth int
+	// Mode is what to do with loops and long chains; empty means
+	// ChainReject.
+	Mode ChainMode
+	// Logger receives the warnings of ChainWarn, each logged
+	// once, when the chain first appears in a table; nil means
+	// standard error.
+	Logger *log.Logger
+}
+
+// check reports invalid settings in p.
+func (p *ChainPolicy) check() error {
+	switch p.Mode {
+	case "", ChainReject, ChainWarn, ChainCollapse:
+	default:
+		return fmt.Errorf("urlshort: unknown chain mode %q", string(p.Mode))
+	}
+	if p.MaxDepth < 0 {
+		return errors.New("urlshort: chain depth must not be negative")
+	}
+	for _, h := range p.Hosts {
+		if err := checkHost(h); err != nil || h == "" {
+			return fmt.Errorf("urlshort: chain policy: invalid host %q", h)
+		}
+	}
+	return nil
+}
+
+// checkChains follows the links in rt that point at other links
+// and applies p to the loops and chains found. rules holds the
+// compiled rule of each link and pos its position in the list
+// compiled, both by key.
+func (rt *routes) checkChains(p *ChainPolicy, rules map[string]*rule, pos map[string]int) RuleErrors {
+	max := p.MaxDepth
+	if max == 0 {
+		max = defaultMaxChain
+	}
+	static := make([]*rule, 0, len(rt.links))
+	for _, l := range rt.links {
+		if r := rules[l.Key()]; !r.isPrefix && len(r.params) == 0 {
+			// Where the others lead depends on the request.
+			static = append(static, r)
+		}
+	}
+	if p.Mode == ChainCollapse {
+		// Chains are all found before any is collapsed, so the
+		// result does not depend on the order of the links.
+		collapsed := make(map[*rule]*template)
+		for _, r := range static {
+			hops, final, plain, loop := rt.chain(r, p.Hosts)
+			if loop || !plain || len(hops) < 2 {
+				continue
+			}
+			if t, err := parseTemplate(strings.Replace(final, "{", "{{", -1)); err == nil {
+				collapsed[r] = t
+			}
+		}
+		for r, t := range collapsed {
+			r.target = t
+		}
+	}
+	var errs RuleErrors
+	for _, r := range static {
+		hops, _, _, loop := rt.chain(r, p.Hosts)
+		var err error
+		switch {
+		case loop:
+			err = fmt.Errorf("redirects in a loop: %s", strings.Join(hops, " -> "))
+		case len(hops) > max:
+			err = fmt.Errorf("redirects through %d links, more than %d: %s", len(hops), max, strings.Join(hops, " -> "))
+		}
+		if err != nil {
+			key := r.link.Key()
+			errs = append(errs, &RuleError{Key: key, Err: err, index: pos[key]})
+		}
+	}
+	if p.Mode != ChainWarn {
+		return errs
+	}
+	// The table logs them when it takes the routes.
+	rt.warnings = errs
+	return nil
+}
+
+// warn logs the warnings in errs that are not in old, the
+// warnings of the routes being replaced, so that each chain is
+// reported once rather than on every change to the table.
+func (p *ChainPolicy) warn(errs, old RuleErrors) {
+	if len(errs) == 0 {
+		return
+	}
+	seen := make(map[string]bool, len(old))
+	for _, e := range old {
+		seen[e.Error()] = true
+	}
+	logger := p.Logger
+	if logger == nil {
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	for _, e := range errs {
+		if !seen[e.Error()] {
+			logger.Printf("urlshort: %v", e)
+		}
+	}
+}
+
+// chain follows r through the links its URL leads to. It returns
+// the keys of the links a visitor goes through, starting with
+// r's, and where they end up. plain reports whether the links
+// after r can be skipped, and loop whether the last one was
+// visited before.
+func (rt *routes) chain(r *rule, hosts []string) (hops []string, final string, plain, loop bool) {
+	hops = []string{r.link.Key()}
+	seen := map[string]bool{hops[0]: true}
+	plain = true
+	target := match{rule: r}.target()
+	for {
+		m, ok := rt.follow(target, hosts)
+		if !ok {
+			return hops, target, plain, false
+		}
+		key := m.link.Key()
+		hops = append(hops, key)
+		if seen[key] {
+			return hops, "", false, true
+		}
+		seen[key] = true
+		l := m.link
+		plain = plain && l.PasswordHash == "" && l.MaxClicks == 0 && l.ExpiresAt == nil && l.Query == ""
+		target = m.target()
+	}
+}
+
+// follow finds the link target leads to, if target is a URL of
+// the server: one whose host is in hosts or has links of its own.
+func (rt *routes) follow(target string, hosts []string) (match, bool) {
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" {
+		return match{}, false
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	_, own := resolveHost(host, func(h string) bool { return h != "" && rt.hosts[h] != nil })
+	if !own && !matchHost(hosts, host) {
+		return match{}, false
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	return rt.lookupHost(host, path)
+}
@@ -0,0 +1,168 @@
+package urlshort
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestChainLoops(t *testing.T) {
+	yml := `
+- path: /a
+  url: https://go.corp/b
+- path: /b
+  url: https://go.corp/a
+- path: /self
+  url: http://GO.corp:8080/self
+- path: /ok
+  url: https://elsewhere.example/a
+`
+	policy := ChainPolicy{Hosts: []string{"go.corp"}}
+	_, err := YAMLHandler([]byte(yml), http.HandlerFunc(fallback), WithChainPolicy(policy))
+	errs, ok := err.(RuleErrors)
+	if !ok {
+		t.Fatalf("err = %v, want RuleErrors", err)
+	}
+	want := []string{
+		"line 2: /a: redirects in a loop: /a -> /b -> /a",
+		"line 4: /b: redirects in a loop: /b -> /a -> /b",
+		"line 6: /self: redirects in a loop: /self -> /self",
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("got %d errors, want %d:\n%v", len(errs), len(want), err)
+	}
+	for i, w := range want {
+		if got := errs[i].Error(); got != w {
+			t.Errorf("error %d = %q, want %q", i, got, w)
+		}
+	}
+
+	// Without the policy, or for hosts that are not ours, links
+	// are not followed.
+	if _, err := YAMLHandler([]byte(yml), http.HandlerFunc(fallback)); err != nil {
+		t.Errorf("without a policy: %v", err)
+	}
+	if _, err := YAMLHandler([]byte(yml), http.HandlerFunc(fallback), WithChainPolicy(ChainPolicy{})); err != nil {
+		t.Errorf("without own hosts: %v", err)
+	}
+
+	// Hosts with links of their own are ours, and so are the
+	// subdomains of wildcards.
+	links := []Link{
+		{Host: "*.go.corp", Path: "/x", URL: "https://eng.go.corp/y"},
+		{Host: "*.go.corp", Path: "/y", URL: "https://hr.go.corp/x"},
+	}
+	if _, err := Handler(NewMemoryStore(links), nil, WithChainPolicy(ChainPolicy{})); err == nil || !strings.Contains(err.Error(), "in a loop") {
+		t.Errorf("host loop: err = %v", err)
+	}
+	if _, err := Handler(NewMemoryStore(links), nil, WithChainPolicy(ChainPolicy{Mode: "sometimes"})); err == nil {
+		t.Error("unknown mode: expected an error")
+	}
+}
+
+func TestChainDepth(t *testing.T) {
+	links := []Link{
+		{Path: "/1", URL: "https://go.corp/2"},
+		{Path: "/2", URL: "https://go.corp/gh/3"},
+		{Path: "/gh/*", URL: "https://go.corp/{rest}"},
+		{Path: "/3", URL: "https://go.corp/4?x=1"},
+		{Path: "/4", URL: "https://final.example"},
+	}
+	_, err := compile(links, ruleConfig{chains: &ChainPolicy{Hosts: []string{"go.corp"}}})
+	errs, ok := err.(RuleErrors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("err = %v, want 2 RuleErrors", err)
+	}
+	if got, want := errs[0].Error(), "/1: redirects through 5 links, more than 3: /1 -> /2 -> /gh/* -> /3 -> /4"; got != want {
+		t.Errorf("error = %q, want %q", got, want)
+	}
+	if errs[1].Key != "/2" {
+		t.Errorf("second error for %s, want /2", errs[1].Key)
+	}
+	if _, err := compile(links, ruleConfig{chains: &ChainPolicy{Hosts: []string{"go.corp"}, MaxDepth: 5}}); err != nil {
+		t.Errorf("MaxDepth 5: %v", err)
+	}
+
+	// Warnings are logged and the links kept.
+	var buf bytes.Buffer
+	policy := ChainPolicy{Hosts: []string{"go.corp"}, Mode: ChainWarn, Logger: log.New(&buf, "", 0)}
+	h, err := Handler(NewMemoryStore(links), http.HandlerFunc(fallback), WithChainPolicy(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRedirect(t, serve(h, "/1"), http.StatusFound, "https://go.corp/2")
+	if got := strings.Count(buf.String(), "urlshort: /"); got != 2 {
+		t.Errorf("logged %d warnings, want 2:\n%s", got, buf.String())
+	}
+
+	// Changes to the table only log the chains they bring.
+	buf.Reset()
+	store := NewMemoryStore(links)
+	table, err := LoadTable(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := table.SetChainPolicy(policy); err != nil {
+		t.Fatal(err)
+	}
+	api := NewAPI(store, table)
+	assertCode(t, apiRequest(t, api, "POST", "/api/v1/links", `{"path": "/x", "url": "https://x.example"}`), http.StatusCreated)
+	assertCode(t, apiRequest(t, api, "POST", "/api/v1/links", `{"path": "/0", "url": "https://go.corp/1"}`), http.StatusCreated)
+	if got := strings.Count(buf.String(), "urlshort: /"); got != 3 {
+		t.Errorf("logged %d warnings, want the 2 on load and 1 for /0:\n%s", got, buf.String())
+	}
+	if !strings.Contains(buf.String(), "urlshort: /0: ") {
+		t.Errorf("no warning for /0:\n%s", buf.String())
+	}
+}
+
+func TestChainCollapse(t *testing.T) {
+	links := []Link{
+		{Path: "/1", URL: "https://go.corp/2"},
+		{Path: "/2", URL: "https://go.corp/gh/a{{b}"},
+		{Path: "/gh/*", URL: "https://github.com/{rest}"},
+		{Path: "/locked", URL: "https://go.corp/1", MaxClicks: 5},
+		{Path: "/via", URL: "https://go.corp/locked"},
+		{Path: "/loop", URL: "https://go.corp/loop"},
+	}
+	policy := ChainPolicy{Hosts: []string{"go.corp"}, MaxDepth: 2, Mode: ChainCollapse}
+	_, err := Handler(NewMemoryStore(links), nil, WithChainPolicy(policy))
+	if err == nil || err.Error() != "urlshort: /loop: redirects in a loop: /loop -> /loop" {
+		t.Fatalf("err = %v, want the loop only", err)
+	}
+
+	table, err := LoadTable(NewMemoryStore(links[:5]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := table.SetChainPolicy(policy); err != nil {
+		t.Fatal(err)
+	}
+	h, err := TableHandler(table, http.HandlerFunc(fallback))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRedirect(t, serve(h, "/1"), http.StatusFound, "https://github.com/a%7Bb%7D")
+	assertRedirect(t, serve(h, "/2"), http.StatusFound, "https://github.com/a%7Bb%7D")
+	// Links counting clicks are never skipped: /via goes through
+	// /locked, which goes straight to GitHub.
+	assertRedirect(t, serve(h, "/via"), http.StatusFound, "https://go.corp/locked")
+	assertRedirect(t, serve(h, "/locked"), http.StatusFound, "https://github.com/a%7Bb%7D")
+
+	// Changes through the API are checked against the policy.
+	store := NewMemoryStore(links[:1])
+	table, err = LoadTable(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := table.SetChainPolicy(ChainPolicy{Hosts: []string{"go.corp"}}); err != nil {
+		t.Fatal(err)
+	}
+	api := NewAPI(store, table)
+	assertCode(t, apiRequest(t, api, "POST", "/api/v1/links", `{"path": "/2", "url": "https://go.corp/1"}`), http.StatusConflict)
+	if _, err := store.Lookup("/2"); err != ErrNotFound {
+		t.Errorf("looping link stored: err = %v", err)
+	}
+}
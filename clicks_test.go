@@ -0,0 +1,121 @@
+package urlshort
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestConsume(t *testing.T) {
+	for name, open := range storeFactories {
+		t.Run(name, func(t *testing.T) {
+			s := open(t, t.TempDir())
+			s.Put(Link{Path: "/once", URL: "https://once.example", MaxClicks: 3})
+			cc := s.(ClickCounter)
+
+			const workers = 10
+			var (
+				wg sync.WaitGroup
+				mu sync.Mutex
+				ok int
+			)
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, err := cc.Consume("/once")
+					if err != nil && err != ErrExhausted {
+						t.Error(err)
+					}
+					if err == nil {
+						mu.Lock()
+						ok++
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+			if ok != 3 {
+				t.Errorf("%d successful clicks, want 3", ok)
+			}
+			if l, _ := s.Lookup("/once"); l.Clicks != 3 {
+				t.Errorf("Clicks = %d, want 3", l.Clicks)
+			}
+		})
+	}
+}
+
+func TestSingleUseLink(t *testing.T) {
+	yml := `
+- path: /invite
+  url: https://chat.example/join
+  max_clicks: 1
+`
+	h, err := YAMLHandler([]byte(yml), http.HandlerFunc(fallback))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRedirect(t, serve(h, "/invite"), http.StatusFound, "https://chat.example/join")
+	if rec := serve(h, "/invite"); rec.Code != http.StatusGone {
+		t.Errorf("second visit: status = %d, want 410", rec.Code)
+	}
+
+	// Without a ClickCounter store the limit cannot be enforced.
+	table, err := NewTable([]Link{{Path: "/invite", URL: "https://chat.example/join", MaxClicks: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	th, _ := TableHandler(table, http.HandlerFunc(fallback))
+	if rec := serve(th, "/invite"); rec.Code != http.StatusGone {
+		t.Errorf("table without store: status = %d, want 410", rec.Code)
+	}
+}
+
+// clickingStore consumes a click of every link looked up, as a
+// visitor would between the lookup and the write of an update.
+type clickingStore struct {
+	*MemoryStore
+}
+
+func (s clickingStore) Lookup(key string) (Link, error) {
+	l, err := s.MemoryStore.Lookup(key)
+	if err == nil {
+		s.MemoryStore.Consume(key)
+	}
+	return l, err
+}
+
+func TestUpdateKeepsClicks(t *testing.T) {
+	for name, open := range storeFactories {
+		t.Run(name, func(t *testing.T) {
+			s := open(t, t.TempDir())
+			s.Put(Link{Path: "/once", URL: "https://once.example", MaxClicks: 1})
+			cc := s.(ClickCounter)
+			if _, err := cc.Consume("/once"); err != nil {
+				t.Fatal(err)
+			}
+			l, err := s.(Updater).Update("/once", func(l *Link) error {
+				l.URL = "https://twice.example"
+				return nil
+			})
+			if err != nil || l.URL != "https://twice.example" || l.Clicks != 1 {
+				t.Fatalf("Update() = %+v, %v", l, err)
+			}
+			if _, err := cc.Consume("/once"); err != ErrExhausted {
+				t.Errorf("Consume() after Update: err = %v, want ErrExhausted", err)
+			}
+			if _, err := s.(Updater).Update("/missing", func(*Link) error { return nil }); err != ErrNotFound {
+				t.Errorf("Update() of a missing link: err = %v", err)
+			}
+		})
+	}
+
+	// A click consumed while the API patches the link stays
+	// consumed.
+	store := clickingStore{NewMemoryStore([]Link{{Path: "/once", URL: "https://once.example", MaxClicks: 1}})}
+	api := NewAPI(store, nil)
+	assertCode(t, apiRequest(t, api, "PATCH", "/api/v1/links/once", `{"url": "https://twice.example"}`), http.StatusOK)
+	if _, err := store.Consume("/once"); err != ErrExhausted {
+		t.Errorf("Consume() after PATCH: err = %v, want ErrExhausted", err)
+	}
+}
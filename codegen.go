@@ -0,0 +1,267 @@
+package urlshort
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	mrand "math/rand"
+	"strings"
+	"sync"
+)
+
+// CodeStrategy selects how a CodeGenerator makes codes.
+type CodeStrategy string
+
+const (
+	// CodeRandom draws every character at random.
+	CodeRandom CodeStrategy = "random"
+	// CodeSequential encodes an increasing counter with a
+	// shuffled alphabet, so codes are short but not guessable
+	// at a glance. The counter is not stored: a new generator
+	// skips the codes already taken in a few lookups.
+	CodeSequential CodeStrategy = "sequential"
+	// CodeHash derives the code from a hash of the target URL.
+	CodeHash CodeStrategy = "hash"
+)
+
+// Base62 is the default alphabet for generated codes.
+const Base62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// DefaultReserved lists the codes never handed out by default,
+// because the server or its operators use those paths.
+var DefaultReserved = []string{"api", "admin", "static", "metrics", "_status"}
+
+// ErrNoCode is returned when no free code could be found.
+var ErrNoCode = errors.New("urlshort: could not find a free code")
+
+// maxCodeTries bounds the number of candidates tried by Generate.
+const maxCodeTries = 100
+
+// CodeGenerator makes short codes for links created without a
+// path. The zero value generates random base62 codes of at
+// least 6 characters.
+//
+// When a random code collides with an existing link more than
+// Attempts times in a row, the generator switches to codes one
+// character longer for good, so the chance of collisions stays
+// low as the keyspace fills up.
+type CodeGenerator struct {
+	Strategy  CodeStrategy
+	MinLength int      // shortest code; default 6
+	Alphabet  string   // characters used; default Base62
+	Reserved  []string // codes never generated; default DefaultReserved
+	Attempts  int      // collisions tolerated per length; default 3
+	// Seed shuffles the alphabet of sequential codes. Keep it
+	// constant so that codes stay stable across restarts.
+	Seed int64
+
+	mu       sync.Mutex
+	length   int    // current length of random and hash codes
+	next     uint64 // next sequential value
+	shuffled string
+}
+
+// Generate returns a path, made of a leading slash and a new
+// code, that is not used in store. target is the URL the link
+// will point to; the hash strategy derives the code from it.
+func (g *CodeGenerator) Generate(store Store, target string) (string, error) {
+	return g.GenerateFor(store, "", target)
+}
+
+// GenerateFor is like Generate for a link of host, whose path
+// only needs to be unused among the links of that host.
+func (g *CodeGenerator) GenerateFor(store Store, host, target string) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.init()
+
+	if g.Strategy == CodeSequential {
+		return g.sequential(store, host)
+	}
+	collisions := 0
+	for try := 0; try < maxCodeTries; try++ {
+		code, err := g.candidate(target, try)
+		if err != nil {
+			return "", err
+		}
+		if !g.reserved(code) {
+			_, err = store.Lookup(Link{Host: host, Path: "/" + code}.Key())
+			if err == ErrNotFound {
+				return "/" + code, nil
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+		collisions++
+		if collisions > g.attempts() {
+			g.length++
+			collisions = 0
+		}
+	}
+	return "", ErrNoCode
+}
+
+// sequential returns the first free sequential code from g.next
+// on, for a link of host. Codes are taken in runs from zero, so
+// past a taken one it probes ever further ahead, then searches
+// back for the first free code between the last taken and the
+// free one found.
+func (g *CodeGenerator) sequential(store Store, host string) (string, error) {
+	free := func(n uint64) (bool, error) {
+		code := g.sequentialCode(n)
+		if g.reserved(code) {
+			return false, nil
+		}
+		_, err := store.Lookup(Link{Host: host, Path: "/" + code}.Key())
+		if err == ErrNotFound {
+			return true, nil
+		}
+		return false, err
+	}
+	lo := g.next
+	ok, err := free(lo)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		g.next = lo + 1
+		return "/" + g.sequentialCode(lo), nil
+	}
+	// lo is taken; find a free hi.
+	hi := lo
+	for step := uint64(1); ; step *= 2 {
+		if step == 0 || hi+step < hi {
+			return "", ErrNoCode
+		}
+		if ok, err = free(hi + step); err != nil {
+			return "", err
+		}
+		if ok {
+			hi += step
+			break
+		}
+		lo = hi + step
+	}
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if ok, err = free(mid); err != nil {
+			return "", err
+		}
+		if ok {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	g.next = hi + 1
+	return "/" + g.sequentialCode(hi), nil
+}
+
+func (g *CodeGenerator) sequentialCode(n uint64) string {
+	return encodeCode(n, g.shuffled, g.minLength())
+}
+
+func (g *CodeGenerator) init() {
+	if g.length == 0 {
+		g.length = g.minLength()
+	}
+	if g.shuffled == "" {
+		b := []byte(g.alphabet())
+		r := mrand.New(mrand.NewSource(g.Seed))
+		r.Shuffle(len(b), func(i, j int) { b[i], b[j] = b[j], b[i] })
+		g.shuffled = string(b)
+	}
+}
+
+func (g *CodeGenerator) candidate(target string, try int) (string, error) {
+	switch g.Strategy {
+	case "", CodeRandom:
+		return randomCode(g.alphabet(), g.length)
+	case CodeHash:
+		// Successive tries hash the URL with a counter, so a
+		// collision yields a different code of the same length.
+		h := sha256.Sum256([]byte(strings.Repeat("#", try) + target))
+		n := new(big.Int).SetBytes(h[:])
+		return bigCode(n, g.alphabet(), g.length), nil
+	}
+	return "", errors.New("urlshort: unknown code strategy " + string(g.Strategy))
+}
+
+func (g *CodeGenerator) reserved(code string) bool {
+	reserved := g.Reserved
+	if reserved == nil {
+		reserved = DefaultReserved
+	}
+	for _, r := range reserved {
+		if strings.EqualFold(code, r) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *CodeGenerator) alphabet() string {
+	if g.Alphabet == "" {
+		return Base62
+	}
+	return g.Alphabet
+}
+
+func (g *CodeGenerator) minLength() int {
+	if g.MinLength <= 0 {
+		return 6
+	}
+	return g.MinLength
+}
+
+func (g *CodeGenerator) attempts() int {
+	if g.Attempts <= 0 {
+		return 3
+	}
+	return g.Attempts
+}
+
+// randomCode returns n characters drawn uniformly from alphabet.
+func randomCode(alphabet string, n int) (string, error) {
+	max := big.NewInt(int64(len(alphabet)))
+	b := make([]byte, n)
+	for i := range b {
+		c, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = alphabet[c.Int64()]
+	}
+	return string(b), nil
+}
+
+// encodeCode writes n in base len(alphabet), padded on the left
+// with the alphabet's first character to at least min digits.
+func encodeCode(n uint64, alphabet string, min int) string {
+	base := uint64(len(alphabet))
+	var b []byte
+	for n > 0 || len(b) < min {
+		b = append(b, alphabet[n%base])
+		n /= base
+	}
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
+
+// bigCode returns the last n digits of x written in base
+// len(alphabet).
+func bigCode(x *big.Int, alphabet string, n int) string {
+	base := big.NewInt(int64(len(alphabet)))
+	x = new(big.Int).Set(x)
+	mod := new(big.Int)
+	b := make([]byte, n)
+	for i := range b {
+		x.DivMod(x, base, mod)
+		b[i] = alphabet[mod.Int64()]
+	}
+	return string(b)
+}
@@ -0,0 +1,104 @@
+package urlshort
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCodeGenerator(t *testing.T) {
+	for _, strategy := range []CodeStrategy{CodeRandom, CodeSequential, CodeHash} {
+		t.Run(string(strategy), func(t *testing.T) {
+			store := NewMemoryStore(nil)
+			g := &CodeGenerator{Strategy: strategy, MinLength: 4}
+			seen := map[string]bool{}
+			for i := 0; i < 200; i++ {
+				path, err := g.Generate(store, "https://example.com/same")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(path) < 5 || !strings.HasPrefix(path, "/") {
+					t.Fatalf("Generate() = %q", path)
+				}
+				if seen[path] {
+					t.Fatalf("Generate() returned %q twice", path)
+				}
+				seen[path] = true
+				store.Put(Link{Path: path, URL: "https://example.com/same"})
+			}
+		})
+	}
+}
+
+func TestCodeGeneratorGrowsAndSkipsReserved(t *testing.T) {
+	// A one-letter alphabet has a single code per length.
+	store := NewMemoryStore(nil)
+	g := &CodeGenerator{Alphabet: "a", MinLength: 1, Attempts: 1, Reserved: []string{"aa"}}
+	var got []string
+	for i := 0; i < 3; i++ {
+		path, err := g.Generate(store, "https://example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.Put(Link{Path: path, URL: "https://example.com"})
+		got = append(got, path)
+	}
+	if want := "/a /aaa /aaaa"; strings.Join(got, " ") != want {
+		t.Errorf("codes = %v, want %s", got, want)
+	}
+}
+
+// countingStore counts the lookups made in a Store.
+type countingStore struct {
+	Store
+	lookups int
+}
+
+func (s *countingStore) Lookup(key string) (Link, error) {
+	s.lookups++
+	return s.Store.Lookup(key)
+}
+
+func TestSequentialCodesAfterRestart(t *testing.T) {
+	store := &countingStore{Store: NewMemoryStore(nil)}
+	g := &CodeGenerator{Strategy: CodeSequential, Seed: 7}
+	seen := map[string]bool{}
+	for i := 0; i < 150; i++ {
+		path, err := g.Generate(store, "https://example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[path] = true
+		store.Put(Link{Path: path, URL: "https://example.com"})
+	}
+
+	// A new generator with the same seed picks up where the old
+	// one stopped.
+	store.lookups = 0
+	g = &CodeGenerator{Strategy: CodeSequential, Seed: 7}
+	path, err := g.Generate(store, "https://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen[path] {
+		t.Errorf("Generate() = %q, already taken", path)
+	}
+	if want := "/" + g.sequentialCode(150); path != want {
+		t.Errorf("Generate() = %q, want %q", path, want)
+	}
+	if store.lookups > 20 {
+		t.Errorf("%d lookups to catch up, want at most 20", store.lookups)
+	}
+	store.Put(Link{Path: path, URL: "https://example.com"})
+	if next, err := g.Generate(store, "https://example.com"); err != nil || next != "/"+g.sequentialCode(151) {
+		t.Errorf("next Generate() = %q, %v", next, err)
+	}
+}
+
+func TestEncodeCode(t *testing.T) {
+	if got := encodeCode(0, "01", 3); got != "000" {
+		t.Errorf("encodeCode(0) = %q", got)
+	}
+	if got := encodeCode(5, "01", 2); got != "101" {
+		t.Errorf("encodeCode(5) = %q", got)
+	}
+}
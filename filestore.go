@@ -0,0 +1,235 @@
+package urlshort
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// FileStore is a Store backed by a YAML or JSON file. The whole
+// file is read into memory when the store is opened and is
+// rewritten on every change. It implements URLIndex,
+// ClickCounter and Updater, but keeps no hits or statistics:
+// those need a BoltStore.
+//
+// Files ending in ".json" are read and written as JSON, all
+// others as YAML, both using the format described on YAMLHandler.
+type FileStore struct {
+	mem   *MemoryStore
+	path  string
+	json  bool
+	wmu   sync.Mutex     // serialises writes to the file
+	lines map[string]int // line of each link in the file, by key; guarded by wmu
+}
+
+// OpenFileStore reads the links stored in the file at path. A
+// missing file is treated as empty and is created on the first
+// write.
+//
+// Links given a ttl in the file are written back with the
+// expires_at it amounts to, here and in Reload, so the TTL is
+// counted from when the link is first loaded.
+func OpenFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		mem:  NewMemoryStore(nil),
+		path: path,
+		json: strings.EqualFold(filepath.Ext(path), ".json"),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	links, ttls, err := s.parse(data, ruleConfig{targets: anyTarget})
+	if err != nil {
+		return nil, err
+	}
+	s.mem.replace(links)
+	if ttls {
+		if err := s.flush(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Reload reads the file again and replaces the links in the
+// store with its content. If the file cannot be read, cannot be
+// parsed or holds invalid rules, the store keeps its current
+// links and the error is returned.
+func (s *FileStore) Reload() error {
+	return s.reload(ruleConfig{targets: anyTarget})
+}
+
+// reload is Reload, checking the rules with cfg, so a Watcher
+// can have the store refuse the links its table would refuse.
+func (s *FileStore) reload(cfg ruleConfig) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	links, ttls, err := s.parse(data, cfg)
+	if err != nil {
+		return err
+	}
+	s.mem.replace(links)
+	if ttls {
+		return s.flush()
+	}
+	return nil
+}
+
+// Path returns the name of the file backing the store.
+func (s *FileStore) Path() string {
+	return s.path
+}
+
+// Lookup implements Store.
+func (s *FileStore) Lookup(key string) (Link, error) {
+	return s.mem.Lookup(key)
+}
+
+// List implements Store.
+func (s *FileStore) List() ([]Link, error) {
+	return s.mem.List()
+}
+
+// LookupURL implements URLIndex.
+func (s *FileStore) LookupURL(owner, host, rawurl string) (Link, error) {
+	return s.mem.LookupURL(owner, host, rawurl)
+}
+
+// Put implements Store.
+func (s *FileStore) Put(link Link) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if err := s.mem.Put(link); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+// Delete implements Store.
+func (s *FileStore) Delete(path string) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if err := s.mem.Delete(path); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+// Consume implements ClickCounter. The new click count is
+// written to the file before Consume returns.
+func (s *FileStore) Consume(path string) (Link, error) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	l, err := s.mem.Consume(path)
+	if err != nil {
+		return l, err
+	}
+	return l, s.flush()
+}
+
+// Update implements Updater. The new link is written to the
+// file before Update returns.
+func (s *FileStore) Update(path string, change func(*Link) error) (Link, error) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	l, err := s.mem.Update(path, change)
+	if err != nil {
+		return l, err
+	}
+	return l, s.flush()
+}
+
+// parse decodes the links in data, checks them with cfg and
+// remembers where each one starts. Unless a Watcher passes the
+// configuration of its table, the URLs of links are only checked
+// for being absolute: the policy they must follow is the one of
+// the tables serving them. ttls reports whether some links had
+// a TTL, now resolved.
+func (s *FileStore) parse(data []byte, cfg ruleConfig) (links []Link, ttls bool, err error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, false, nil
+	}
+	decode := decodeYAML
+	if s.json {
+		decode = decodeJSON
+	}
+	links, lines, err := decode(data)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, l := range links {
+		ttls = ttls || l.TTL != ""
+	}
+	if err := checkRules(links, lines, cfg); err != nil {
+		return nil, false, err
+	}
+	s.setLines(links, lines)
+	return links, ttls, nil
+}
+
+// setLines records that links start on lines, as written in the
+// file.
+func (s *FileStore) setLines(links []Link, lines []int) {
+	s.lines = make(map[string]int, len(lines))
+	for i, line := range lines {
+		s.lines[links[i].Key()] = line
+	}
+}
+
+func (s *FileStore) ruleLine(key string) int {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return s.lines[key]
+}
+
+// flush writes the current links to a temporary file next to
+// the backing file and renames it into place, so readers never
+// observe a partially written file.
+func (s *FileStore) flush() error {
+	links, err := s.mem.List()
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if s.json {
+		data, err = json.MarshalIndent(links, "", "  ")
+	} else {
+		data, err = yaml.Marshal(links)
+	}
+	if err != nil {
+		return err
+	}
+	lines := yamlLines
+	if s.json {
+		lines = jsonLines
+	}
+	s.setLines(links, lines(data, len(links)))
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".urlshort-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -1,7 +1,13 @@
 package urlshort
 
 import (
+	"encoding/json"
+	"log"
 	"net/http"
+	"sort"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
 )
 
 // MapHandler will return an http.HandlerFunc (which also
@@ -10,9 +16,36 @@ import (
 // that each key in the map points to, in string format).
 // If the path is not provided in the map, then the fallback
 // http.Handler will be called instead.
+//
+// Paths and URLs follow the rules described on YAMLHandler.
+// Invalid entries, such as relative URLs, are logged with the
+// standard logger and left out; use Handler with a MemoryStore
+// to get an error instead.
 func MapHandler(pathsToUrls map[string]string, fallback http.Handler) http.HandlerFunc {
-	//	TODO: Implement this...
-	return nil
+	links := buildLinks(pathsToUrls)
+	for {
+		h, err := Handler(NewMemoryStore(links), fallback)
+		errs, ok := err.(RuleErrors)
+		if !ok {
+			if err != nil {
+				// A MemoryStore does not fail.
+				panic(err)
+			}
+			return h
+		}
+		invalid := make(map[string]bool, len(errs))
+		for _, e := range errs {
+			log.Printf("urlshort: skipping %v", e)
+			invalid[e.Key] = true
+		}
+		valid := links[:0]
+		for _, l := range links {
+			if !invalid[l.Key()] {
+				valid = append(valid, l)
+			}
+		}
+		links = valid
+	}
 }
 
 // YAMLHandler will parse the provided YAML and then return
@@ -26,12 +59,241 @@ func MapHandler(pathsToUrls map[string]string, fallback http.Handler) http.Handl
 //     - path: /some-path
 //       url: https://www.some-url.com/demo
 //
-// The only errors that can be returned all related to having
-// invalid YAML data.
+// A path ending in "*" is a prefix rule matching every path
+// that starts with the rest of it. The unmatched remainder of
+// the request path replaces "{rest}" in the url, or is appended
+// to the url's path, after a slash, when there is no
+// placeholder; when several prefix rules match, the longest one
+// wins, and an exact path always beats a prefix:
+//
+//     - path: /gh/*
+//       url: https://github.com/{rest}
+//
+// A path segment starting with ":" is a named parameter
+// matching any single segment. Its value is substituted,
+// URL-escaped, for the placeholder of the same name in the
+// url. Every placeholder must be bound by the path, and sit in
+// the url's path, query or fragment, never in its scheme or
+// host:
+//
+//     - path: /issue/:id
+//       url: https://tracker.example/browse/PROJ-{id}
+//
+// Static segments take precedence over parameters. Write "{{"
+// for a literal "{" in a url.
+//
+// The optional query field chooses what happens to the query
+// string of the request: "drop" it, "append" it to the url's
+// own query, or merge both with "merge_target" (the url's
+// parameters win) or "merge_request" (the request's win). Rules
+// without one use the handler's default, see WithQueryPolicy:
+//
+//     - path: /campaign
+//       url: https://shop.example/?src=go
+//       query: merge_target
+//
+// The optional status field sets the redirect status code: 301
+// or 308 for permanent links that clients may cache, 302, 303
+// or 307 for temporary ones. Rules without one use the handler's
+// default, see WithStatus; any other code is rejected:
+//
+//     - path: /brand
+//       url: https://brand.example
+//       status: 301
+//
+// A link stops redirecting at its optional expires_at time, or
+// ttl after it was loaded; requests for it then get 410 Gone,
+// or the handler set with WithExpiredHandler:
+//
+//     - path: /register
+//       url: https://events.example/signup
+//       expires_at: 2030-01-31T23:59:59Z
+//
+// A link with max_clicks redirects that many times and then
+// responds 410 Gone, or calls the handler set with
+// WithExhaustedHandler. Clicks are counted by the store, which
+// must implement ClickCounter:
+//
+//     - path: /invite
+//       url: https://chat.example/join/abc
+//       max_clicks: 1
+//
+// A link with a password_hash, made with HashPassword, shows a
+// password form instead of redirecting. A correct password sets
+// a signed cookie unlocking the link for a while, see
+// WithUnlockTTL, and redirects; attempts are rate limited per
+// link, see WithPasswordAttempts.
+//
+// The optional host field puts a link in the namespace of a
+// domain, so one handler can serve several short domains. A
+// host starting with "*." serves the subdomains of the rest,
+// the closest one winning. Requests for a host without links of
+// its own use the links without a host, the default domain;
+// those for a host with links never fall back to them. Misses
+// go to the handler set with WithHostFallback for the host, if
+// any:
+//
+//     - host: go.corp
+//       path: /docs
+//       url: https://docs.corp.example
+//     - host: "*.example.com"
+//       path: /docs
+//       url: https://docs.example.com
+//
+// Paths are matched as they are written unless the handler is
+// given WithPathNorm, which can have /Docs, /docs/ and //docs
+// all reach the link for /docs. Rules that collide once
+// normalized are rejected.
+//
+// Every url must be an absolute http or https URL, unless the
+// handler is given a different policy with WithTargetPolicy.
+// With WithChainPolicy, urls leading back to the handler's own
+// links are followed, and loops and long chains rejected.
+//
+// The only errors that can be returned are related to having
+// invalid YAML data or invalid rules. Invalid rules are all
+// reported at once, with their line numbers, in a RuleErrors.
 //
 // See MapHandler to create a similar http.HandlerFunc via
 // a mapping of paths to urls.
-func YAMLHandler(yml []byte, fallback http.Handler) (http.HandlerFunc, error) {
-	// TODO: Implement this...
-	return nil, nil
+func YAMLHandler(yml []byte, fallback http.Handler, opts ...Option) (http.HandlerFunc, error) {
+	links, _, err := parseYAML(yml, newOptions(opts).rules())
+	if err != nil {
+		return nil, err
+	}
+	return Handler(NewMemoryStore(links), fallback, opts...)
+}
+
+// JSONHandler is the JSON counterpart of YAMLHandler. The JSON
+// is expected to be in the format:
+//
+//     [{"path": "/some-path", "url": "https://www.some-url.com/demo"}]
+func JSONHandler(data []byte, fallback http.Handler, opts ...Option) (http.HandlerFunc, error) {
+	links, _, err := parseJSON(data, newOptions(opts).rules())
+	if err != nil {
+		return nil, err
+	}
+	return Handler(NewMemoryStore(links), fallback, opts...)
+}
+
+// Handler returns an http.HandlerFunc that redirects requests
+// matching the links held in store, using the rules described
+// on YAMLHandler, and calls fallback for every other request.
+// The links are read from the store once, when the handler is
+// built; use LoadTable and TableHandler to pick up later
+// changes. Errors come from the store or from invalid rules.
+func Handler(store Store, fallback http.Handler, opts ...Option) (http.HandlerFunc, error) {
+	o := newOptions(opts)
+	if err := o.check(); err != nil {
+		return nil, err
+	}
+	t := &Table{store: store, cfg: o.rules()}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return tableHandler(t, fallback, o), nil
+}
+
+func tableHandler(t *Table, fallback http.Handler, o options) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info := requestInfoFrom(r)
+		host := requestHost(r)
+		start := time.Now()
+		m, ok := t.lookup(host, r.URL.Path)
+		info.lookedUp(time.Since(start))
+		if !ok {
+			info.served(outcomeMiss, "")
+			o.fallback(host, fallback).ServeHTTP(w, r)
+			return
+		}
+		key := m.link.Key()
+		if m.link.Expired(time.Now()) {
+			info.served(outcomeExpired, key)
+			o.expired.ServeHTTP(w, r)
+			return
+		}
+		if m.link.PasswordHash != "" && !o.unlock(w, r, m.link) {
+			info.served(outcomeLocked, key)
+			return
+		}
+		if m.link.MaxClicks > 0 {
+			switch err := t.consume(key); err {
+			case nil:
+			case ErrExhausted, ErrNotFound:
+				info.served(outcomeExhausted, key)
+				o.exhausted.ServeHTTP(w, r)
+				return
+			default:
+				info.served(outcomeError, key)
+				info.failed()
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+		policy := m.link.Query
+		if policy == "" {
+			policy = o.query
+		}
+		status := m.link.Status
+		if status == 0 {
+			status = o.status
+		}
+		if m.link.PasswordHash != "" && r.Method == http.MethodPost {
+			// Sent from the password form: have the browser
+			// follow with a GET.
+			status = http.StatusSeeOther
+		}
+		info.served(outcomeRedirect, key)
+		http.Redirect(w, r, applyQuery(m.target(), r.URL.RawQuery, policy), status)
+		if o.recorder != nil {
+			o.recorder.Record(key, r)
+		}
+	}
+}
+
+// parseYAML decodes the rules in data and checks them with cfg.
+// It also returns the line each rule starts on, or nil if they
+// are not known.
+func parseYAML(data []byte, cfg ruleConfig) ([]Link, []int, error) {
+	links, lines, err := decodeYAML(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return links, lines, checkRules(links, lines, cfg)
+}
+
+// parseJSON is the JSON counterpart of parseYAML.
+func parseJSON(data []byte, cfg ruleConfig) ([]Link, []int, error) {
+	links, lines, err := decodeJSON(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return links, lines, checkRules(links, lines, cfg)
+}
+
+// decodeYAML is parseYAML without the checks.
+func decodeYAML(data []byte) ([]Link, []int, error) {
+	var links []Link
+	if err := yaml.Unmarshal(data, &links); err != nil {
+		return nil, nil, err
+	}
+	return links, yamlLines(data, len(links)), nil
+}
+
+// decodeJSON is parseJSON without the checks.
+func decodeJSON(data []byte) ([]Link, []int, error) {
+	var links []Link
+	if err := json.Unmarshal(data, &links); err != nil {
+		return nil, nil, err
+	}
+	return links, jsonLines(data, len(links)), nil
+}
+
+func buildLinks(pathsToUrls map[string]string) []Link {
+	links := make([]Link, 0, len(pathsToUrls))
+	for path, url := range pathsToUrls {
+		links = append(links, Link{Path: path, URL: url})
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Path < links[j].Path })
+	return links
 }
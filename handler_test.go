@@ -0,0 +1,136 @@
+package urlshort
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+var fallbackBody = "fallback"
+
+func fallback(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, fallbackBody)
+}
+
+func serve(h http.Handler, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec
+}
+
+func assertRedirect(t *testing.T, rec *httptest.ResponseRecorder, code int, location string) {
+	t.Helper()
+	if rec.Code != code {
+		t.Errorf("status = %d, want %d", rec.Code, code)
+	}
+	if got := rec.Header().Get("Location"); got != location {
+		t.Errorf("Location = %q, want %q", got, location)
+	}
+}
+
+func assertFallback(t *testing.T, rec *httptest.ResponseRecorder) {
+	t.Helper()
+	if body := rec.Body.String(); body != fallbackBody {
+		t.Errorf("body = %q, want fallback", body)
+	}
+}
+
+func TestMapHandler(t *testing.T) {
+	h := MapHandler(map[string]string{"/dogs": "https://dogs.example/story"}, http.HandlerFunc(fallback))
+
+	assertRedirect(t, serve(h, "/dogs"), http.StatusFound, "https://dogs.example/story")
+	assertFallback(t, serve(h, "/cats"))
+}
+
+func TestMapHandlerSkipsInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	h := MapHandler(map[string]string{
+		"/dogs":     "https://dogs.example/story",
+		"/relative": "story.html",
+		"no-slash":  "https://cats.example",
+	}, http.HandlerFunc(fallback))
+	assertRedirect(t, serve(h, "/dogs"), http.StatusFound, "https://dogs.example/story")
+	assertFallback(t, serve(h, "/relative"))
+	for _, want := range []string{"skipping /relative: ", "skipping no-slash: "} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("log lacks %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestYAMLHandler(t *testing.T) {
+	yml := `
+- path: /urlshort
+  url: https://github.com/gophercises/urlshort
+`
+	h, err := YAMLHandler([]byte(yml), http.HandlerFunc(fallback))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRedirect(t, serve(h, "/urlshort"), http.StatusFound, "https://github.com/gophercises/urlshort")
+	assertFallback(t, serve(h, "/other"))
+
+	if _, err := YAMLHandler([]byte("- path: [oops"), http.HandlerFunc(fallback)); err == nil {
+		t.Error("invalid YAML: expected an error")
+	}
+}
+
+func TestJSONHandler(t *testing.T) {
+	js := `[{"path": "/urlshort", "url": "https://github.com/gophercises/urlshort"}]`
+	h, err := JSONHandler([]byte(js), http.HandlerFunc(fallback))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRedirect(t, serve(h, "/urlshort"), http.StatusFound, "https://github.com/gophercises/urlshort")
+	assertFallback(t, serve(h, "/other"))
+}
+
+func TestYAMLHandlerPrefixRules(t *testing.T) {
+	yml := `
+- path: /gh/*
+  url: https://github.com/{rest}
+- path: /gh/gophercises
+  url: https://gophercises.com
+`
+	h, err := YAMLHandler([]byte(yml), http.HandlerFunc(fallback))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRedirect(t, serve(h, "/gh/golang/go"), http.StatusFound, "https://github.com/golang/go")
+	assertRedirect(t, serve(h, "/gh/gophercises"), http.StatusFound, "https://gophercises.com")
+	assertFallback(t, serve(h, "/gl/golang"))
+}
+
+func TestRedirectStatus(t *testing.T) {
+	yml := `
+- path: /brand
+  url: https://brand.example
+  status: 301
+- path: /promo
+  url: https://promo.example
+`
+	h, err := YAMLHandler([]byte(yml), http.HandlerFunc(fallback), WithStatus(http.StatusTemporaryRedirect))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRedirect(t, serve(h, "/brand"), http.StatusMovedPermanently, "https://brand.example")
+	assertRedirect(t, serve(h, "/promo"), http.StatusTemporaryRedirect, "https://promo.example")
+
+	for _, code := range []int{200, 304, 404} {
+		bad := fmt.Sprintf("- {path: /a, url: https://a.example, status: %d}", code)
+		if _, err := YAMLHandler([]byte(bad), http.HandlerFunc(fallback)); err == nil {
+			t.Errorf("rule status %d: expected an error", code)
+		}
+		if _, err := YAMLHandler([]byte(yml), http.HandlerFunc(fallback), WithStatus(code)); err == nil {
+			t.Errorf("default status %d: expected an error", code)
+		}
+	}
+}
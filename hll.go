@@ -0,0 +1,162 @@
+package urlshort
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+)
+
+const (
+	// hllPrecision is the number of hash bits choosing a
+	// register. 2^12 registers give a standard error of about
+	// 1.6%.
+	hllPrecision = 12
+	hllRegisters = 1 << hllPrecision
+
+	hllDense  = 1 // format: version, then one byte per register
+	hllSparse = 2 // format: version, then (index, value) triples
+)
+
+// HLL is a HyperLogLog sketch estimating the number of distinct
+// values added to it, in constant space. Sketches can be merged
+// to count the distinct values of their union. The zero value is
+// an empty sketch.
+type HLL struct {
+	reg []uint8 // nil until the first Add
+}
+
+// Add adds a value, given by its 64-bit hash, to the sketch.
+func (h *HLL) Add(hash uint64) {
+	if h.reg == nil {
+		h.reg = make([]uint8, hllRegisters)
+	}
+	i := hash >> (64 - hllPrecision)
+	// The guard bit bounds the rank when the remaining bits are
+	// all zero.
+	w := hash<<hllPrecision | 1<<(hllPrecision-1)
+	if r := uint8(bits.LeadingZeros64(w) + 1); r > h.reg[i] {
+		h.reg[i] = r
+	}
+}
+
+// Merge adds the values counted by o to h.
+func (h *HLL) Merge(o *HLL) {
+	if o == nil || o.reg == nil {
+		return
+	}
+	if h.reg == nil {
+		h.reg = make([]uint8, hllRegisters)
+	}
+	for i, r := range o.reg {
+		if r > h.reg[i] {
+			h.reg[i] = r
+		}
+	}
+}
+
+// Estimate returns the approximate number of distinct values
+// added to the sketch.
+func (h *HLL) Estimate() uint64 {
+	if h == nil || h.reg == nil {
+		return 0
+	}
+	const m = float64(hllRegisters)
+	sum, zeros := 0.0, 0
+	for _, r := range h.reg {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small sets.
+		e = m * math.Log(m/float64(zeros))
+	}
+	return uint64(e + 0.5)
+}
+
+// MarshalBinary encodes the sketch, listing only the registers
+// in use when that is shorter.
+func (h *HLL) MarshalBinary() ([]byte, error) {
+	used := 0
+	for _, r := range h.reg {
+		if r != 0 {
+			used++
+		}
+	}
+	if 3*used >= hllRegisters {
+		return append([]byte{hllDense}, h.reg...), nil
+	}
+	b := make([]byte, 1, 1+3*used)
+	b[0] = hllSparse
+	for i, r := range h.reg {
+		if r != 0 {
+			b = append(b, byte(i>>8), byte(i), r)
+		}
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes a sketch encoded by MarshalBinary.
+func (h *HLL) UnmarshalBinary(b []byte) error {
+	errInvalid := errors.New("urlshort: invalid HyperLogLog sketch")
+	if len(b) == 0 {
+		return errInvalid
+	}
+	reg := make([]uint8, hllRegisters)
+	switch b[0] {
+	case hllDense:
+		if len(b) != 1+hllRegisters {
+			return errInvalid
+		}
+		copy(reg, b[1:])
+	case hllSparse:
+		if (len(b)-1)%3 != 0 {
+			return errInvalid
+		}
+		for p := b[1:]; len(p) > 0; p = p[3:] {
+			i := int(p[0])<<8 | int(p[1])
+			if i >= hllRegisters {
+				return errInvalid
+			}
+			reg[i] = p[2]
+		}
+	default:
+		return errInvalid
+	}
+	h.reg = reg
+	return nil
+}
+
+// MarshalText encodes the sketch in base64, so that it can be
+// stored in JSON documents.
+func (h *HLL) MarshalText() ([]byte, error) {
+	b, err := h.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	text := make([]byte, base64.StdEncoding.EncodedLen(len(b)))
+	base64.StdEncoding.Encode(text, b)
+	return text, nil
+}
+
+// UnmarshalText decodes a sketch encoded by MarshalText.
+func (h *HLL) UnmarshalText(text []byte) error {
+	b := make([]byte, base64.StdEncoding.DecodedLen(len(text)))
+	n, err := base64.StdEncoding.Decode(b, text)
+	if err != nil {
+		return err
+	}
+	return h.UnmarshalBinary(b[:n])
+}
+
+// visitorHash identifies the visitor behind a hit: the hash of
+// its client address hash, which is salted, and its user agent.
+func visitorHash(h Hit) uint64 {
+	sum := sha256.Sum256([]byte(h.IPHash + "\x00" + h.UserAgent))
+	return binary.BigEndian.Uint64(sum[:8])
+}
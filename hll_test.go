@@ -0,0 +1,69 @@
+package urlshort
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+)
+
+func hllHash(i int) uint64 {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(i))
+	sum := sha256.Sum256(b[:])
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func assertEstimate(t *testing.T, h *HLL, want int) {
+	t.Helper()
+	got := float64(h.Estimate())
+	if d := got/float64(want) - 1; d > 0.05 || d < -0.05 {
+		t.Errorf("Estimate() = %v, want %d within 5%%", got, want)
+	}
+}
+
+func TestHLL(t *testing.T) {
+	var h HLL
+	if h.Estimate() != 0 {
+		t.Errorf("empty Estimate() = %d", h.Estimate())
+	}
+	for i := 0; i < 100; i++ {
+		h.Add(hllHash(i))
+		h.Add(hllHash(i))
+	}
+	assertEstimate(t, &h, 100)
+
+	var a, b HLL
+	for i := 0; i < 60000; i++ {
+		a.Add(hllHash(i))
+	}
+	for i := 40000; i < 100000; i++ {
+		b.Add(hllHash(i))
+	}
+	assertEstimate(t, &a, 60000)
+	a.Merge(&b)
+	assertEstimate(t, &a, 100000)
+}
+
+func TestHLLEncoding(t *testing.T) {
+	for _, n := range []int{10, 50000} {
+		var h HLL
+		for i := 0; i < n; i++ {
+			h.Add(hllHash(i))
+		}
+		b, err := json.Marshal(&h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got HLL
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Estimate() != h.Estimate() {
+			t.Errorf("%d values: decoded estimate %d, want %d", n, got.Estimate(), h.Estimate())
+		}
+	}
+	if err := new(HLL).UnmarshalBinary([]byte{hllSparse, 0xff, 0xff, 1}); err == nil {
+		t.Error("out of range register was accepted")
+	}
+}
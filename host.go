@@ -0,0 +1,62 @@
+package urlshort
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// checkHost reports whether host is valid for Link.Host: empty,
+// or a lower-case domain name, optionally preceded by "*." to
+// stand for its subdomains.
+func checkHost(host string) error {
+	if host == "" {
+		return nil
+	}
+	for _, label := range strings.Split(strings.TrimPrefix(host, "*."), ".") {
+		ok := label != "" && label[0] != '-' && label[len(label)-1] != '-'
+		for i := 0; ok && i < len(label); i++ {
+			c := label[i]
+			ok = 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-'
+		}
+		if !ok {
+			return fmt.Errorf("invalid host %q: want a lower-case domain name, optionally starting with \"*.\"", host)
+		}
+	}
+	return nil
+}
+
+// resolveHost returns the host pattern, among those has reports,
+// serving host: host itself, or else the wildcard for its
+// closest parent domain. For "a.b.example.com", "*.b.example.com"
+// is tried before "*.example.com"; "*.example.com" does not
+// cover "example.com" itself.
+func resolveHost(host string, has func(string) bool) (string, bool) {
+	if host == "" {
+		return "", false
+	}
+	if has(host) {
+		return host, true
+	}
+	for rest := host; ; {
+		i := strings.IndexByte(rest, '.')
+		if i < 0 {
+			return "", false
+		}
+		if p := "*" + rest[i:]; has(p) {
+			return p, true
+		}
+		rest = rest[i+1:]
+	}
+}
+
+// requestHost returns the host r was sent to, lower-cased and
+// without port or trailing dot.
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
@@ -0,0 +1,195 @@
+package urlshort
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestResolveHost(t *testing.T) {
+	hosts := map[string]bool{"go.corp": true, "*.example.com": true, "*.eu.example.com": true}
+	has := func(h string) bool { return hosts[h] }
+	for host, want := range map[string]string{
+		"go.corp":          "go.corp",
+		"a.go.corp":        "",
+		"s.example.com":    "*.example.com",
+		"a.b.example.com":  "*.example.com",
+		"s.eu.example.com": "*.eu.example.com",
+		"example.com":      "",
+		"":                 "",
+	} {
+		got, ok := resolveHost(host, has)
+		if got != want || ok != (want != "") {
+			t.Errorf("resolveHost(%q) = %q, %v, want %q", host, got, ok, want)
+		}
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	for _, host := range []string{"", "go.corp", "*.example.com", "lnk.example.io", "a-b.example"} {
+		if err := checkHost(host); err != nil {
+			t.Errorf("checkHost(%q) = %v", host, err)
+		}
+	}
+	for _, host := range []string{"Go.corp", "*", "a.*.example", "example..com", "-a.example", "go.corp:80", "go.corp/x"} {
+		if err := checkHost(host); err == nil {
+			t.Errorf("checkHost(%q): expected an error", host)
+		}
+	}
+}
+
+func TestHostRouting(t *testing.T) {
+	yml := `
+- path: /docs
+  url: https://default.example/docs
+- path: /only-default
+  url: https://default.example/only
+- host: go.corp
+  path: /docs
+  url: https://corp.example/docs
+- host: "*.example.com"
+  path: /docs
+  url: https://wild.example/docs
+- host: "*.eu.example.com"
+  path: /gh/*
+  url: https://github.com/{rest}
+`
+	h, err := YAMLHandler([]byte(yml), http.HandlerFunc(fallback))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRedirect(t, serve(h, "http://go.corp/docs"), http.StatusFound, "https://corp.example/docs")
+	assertRedirect(t, serve(h, "http://GO.corp.:8080/docs"), http.StatusFound, "https://corp.example/docs")
+	assertRedirect(t, serve(h, "http://s.example.com/docs"), http.StatusFound, "https://wild.example/docs")
+	assertRedirect(t, serve(h, "http://s.eu.example.com/gh/x"), http.StatusFound, "https://github.com/x")
+	assertRedirect(t, serve(h, "http://lnk.example.io/docs"), http.StatusFound, "https://default.example/docs")
+	assertRedirect(t, serve(h, "http://example.com/docs"), http.StatusFound, "https://default.example/docs")
+
+	// Hosts with links of their own do not see the default ones.
+	assertFallback(t, serve(h, "http://go.corp/only-default"))
+	assertFallback(t, serve(h, "http://s.eu.example.com/docs"))
+
+	if _, err := YAMLHandler([]byte("- host: Go.Corp\n  path: /x\n  url: https://x.example\n"), nil); err == nil {
+		t.Error("invalid host: expected an error")
+	}
+}
+
+func TestHostFallback(t *testing.T) {
+	hostFallback := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name)
+		})
+	}
+	h, err := Handler(NewMemoryStore([]Link{
+		{Host: "go.corp", Path: "/docs", URL: "https://corp.example/docs"},
+	}), http.HandlerFunc(fallback),
+		WithHostFallback("go.corp", hostFallback("corp")),
+		WithHostFallback("*.example.com", hostFallback("wild")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for target, want := range map[string]string{
+		"http://go.corp/nope":          "corp",
+		"http://s.example.com/nope":    "wild",
+		"http://lnk.example.io/nope":   fallbackBody,
+		"http://go.corp.example/nope":  fallbackBody,
+		"http://a.s.example.com/x/y/z": "wild",
+	} {
+		if body := serve(h, target).Body.String(); body != want {
+			t.Errorf("%s: body = %q, want %q", target, body, want)
+		}
+	}
+	assertRedirect(t, serve(h, "http://go.corp/docs"), http.StatusFound, "https://corp.example/docs")
+
+	if _, err := Handler(NewMemoryStore(nil), nil, WithHostFallback("", hostFallback("x"))); err == nil {
+		t.Error("fallback for an empty host: expected an error")
+	}
+}
+
+func TestStoreHosts(t *testing.T) {
+	for name, open := range storeFactories {
+		t.Run(name, func(t *testing.T) {
+			s := open(t, t.TempDir())
+			for _, l := range []Link{
+				{Host: "go.corp", Path: "/docs", URL: "https://corp.example"},
+				{Path: "/docs", URL: "https://default.example"},
+				{Host: "*.example.com", Path: "/docs", URL: "https://wild.example"},
+			} {
+				if err := s.Put(l); err != nil {
+					t.Fatal(err)
+				}
+			}
+			links, err := s.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for _, l := range links {
+				keys = append(keys, l.Key())
+			}
+			if fmt.Sprint(keys) != "[/docs *.example.com/docs go.corp/docs]" {
+				t.Errorf("List keys = %v", keys)
+			}
+			if l, err := s.Lookup("go.corp/docs"); err != nil || l.Host != "go.corp" || l.URL != "https://corp.example" {
+				t.Errorf("Lookup(go.corp/docs) = %+v, %v", l, err)
+			}
+			if l, err := s.Lookup("/docs"); err != nil || l.Host != "" || l.URL != "https://default.example" {
+				t.Errorf("Lookup(/docs) = %+v, %v", l, err)
+			}
+			if err := s.Delete("go.corp/docs"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Lookup("go.corp/docs"); err != ErrNotFound {
+				t.Errorf("Lookup after Delete: err = %v, want ErrNotFound", err)
+			}
+			if _, err := s.Lookup("/docs"); err != nil {
+				t.Errorf("Delete removed the default domain link: %v", err)
+			}
+			if err := s.Delete("go.corp/docs"); err != ErrNotFound {
+				t.Errorf("second Delete: err = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestAPIHosts(t *testing.T) {
+	store := NewMemoryStore(nil)
+	table, err := LoadTable(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := NewAPI(store, table)
+	h, err := TableHandler(table, http.HandlerFunc(fallback))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertCode(t, apiRequest(t, api, "POST", "/api/v1/links", `{"path": "/docs", "url": "https://default.example"}`), http.StatusCreated)
+	assertCode(t, apiRequest(t, api, "POST", "/api/v1/links", `{"host": "go.corp", "path": "/docs", "url": "https://corp.example"}`), http.StatusCreated)
+	assertCode(t, apiRequest(t, api, "POST", "/api/v1/links", `{"host": "go.corp", "path": "/docs", "url": "https://other.example"}`), http.StatusConflict)
+	assertCode(t, apiRequest(t, api, "POST", "/api/v1/links", `{"host": "Go.Corp", "path": "/x", "url": "https://x.example"}`), http.StatusBadRequest)
+	assertRedirect(t, serve(h, "http://go.corp/docs"), http.StatusFound, "https://corp.example")
+	assertRedirect(t, serve(h, "http://other.example/docs"), http.StatusFound, "https://default.example")
+
+	assertCode(t, apiRequest(t, api, "PATCH", "/api/v1/links/docs?host=go.corp", `{"url": "https://corp2.example"}`), http.StatusOK)
+	assertRedirect(t, serve(h, "http://go.corp/docs"), http.StatusFound, "https://corp2.example")
+	assertRedirect(t, serve(h, "http://other.example/docs"), http.StatusFound, "https://default.example")
+
+	rec := apiRequest(t, api, "GET", "/api/v1/links?host=go.corp", "")
+	assertCode(t, rec, http.StatusOK)
+	var page linkPage
+	if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 1 || page.Links[0].Host != "go.corp" {
+		t.Errorf("page = %+v", page)
+	}
+
+	assertCode(t, apiRequest(t, api, "GET", "/api/v1/links/docs?host=Go.Corp", ""), http.StatusBadRequest)
+	assertCode(t, apiRequest(t, api, "DELETE", "/api/v1/links/docs?host=go.corp", ""), http.StatusNoContent)
+	assertCode(t, apiRequest(t, api, "GET", "/api/v1/links/docs?host=go.corp", ""), http.StatusNotFound)
+	assertCode(t, apiRequest(t, api, "GET", "/api/v1/links/docs", ""), http.StatusOK)
+	assertFallback(t, serve(h, "http://go.corp/nope"))
+}
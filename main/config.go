@@ -0,0 +1,354 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gophercises/urlshort"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// config is how the server is set up. Each setting can come from
+// a YAML (or JSON) config file, an environment variable or a
+// flag. Flags win over the environment, which wins over the
+// file, which wins over the defaults:
+//
+//     addr: ":8080"              # -addr, URLSHORT_ADDR
+//     tls:
+//       cert: server.crt         # -tls-cert, URLSHORT_TLS_CERT
+//       key: server.key          # -tls-key, URLSHORT_TLS_KEY
+//     store:
+//       backend: file            # -store, URLSHORT_STORE: demo, file or bolt
+//       dsn: links.yaml          # -dsn, URLSHORT_DSN: the file or database
+//     status: 302                # -status, URLSHORT_STATUS
+//     normalize_paths: all       # -normalize-paths, URLSHORT_NORMALIZE_PATHS
+//     targets:
+//       schemes: [https]         # -allow-schemes, URLSHORT_ALLOW_SCHEMES
+//       allow_hosts: ["*.corp"]  # -allow-hosts, URLSHORT_ALLOW_HOSTS
+//       deny_hosts: [bad.test]   # -deny-hosts, URLSHORT_DENY_HOSTS
+//     chains:
+//       hosts: [go.corp]         # -own-hosts, URLSHORT_OWN_HOSTS
+//       max_depth: 3             # -max-chain, URLSHORT_MAX_CHAIN
+//       mode: reject             # -chain-mode, URLSHORT_CHAIN_MODE: reject, warn or collapse
+//     admin:
+//       addr: localhost:8081     # -admin-addr, URLSHORT_ADMIN_ADDR
+//       token: s3cret            # -admin-token, URLSHORT_ADMIN_TOKEN
+//     fallback:
+//       mode: redirect           # -fallback, URLSHORT_FALLBACK: suggest, demo, not_found or redirect
+//       url: https://example.com # -fallback-url, URLSHORT_FALLBACK_URL
+//     access_log:
+//       output: "-"              # -access-log, URLSHORT_ACCESS_LOG
+//       format: json             # -access-log-format, URLSHORT_ACCESS_LOG_FORMAT
+//     shutdown_timeout: 30s      # -shutdown-timeout, URLSHORT_SHUTDOWN_TIMEOUT
+//
+// The admin API is off unless admin.addr or admin.token is set.
+// With an address, it is served there rather than next to the
+// links; with a token, every request to it must carry the token.
+// Hits and statistics are only kept by the bolt backend.
+//
+// The file is named by -config or URLSHORT_CONFIG. On SIGHUP, the
+// server reads it and the environment again, and applies the
+// new normalize_paths, targets and chains settings; the others
+// need a restart.
+type config struct {
+	Addr string `yaml:"addr"`
+	TLS  struct {
+		Cert string `yaml:"cert,omitempty"`
+		Key  string `yaml:"key,omitempty"`
+	} `yaml:"tls"`
+	Store struct {
+		Backend string `yaml:"backend"`
+		DSN     string `yaml:"dsn,omitempty"`
+	} `yaml:"store"`
+	Status         int    `yaml:"status"`
+	NormalizePaths string `yaml:"normalize_paths,omitempty"`
+	Targets        struct {
+		Schemes    []string `yaml:"schemes,omitempty,flow"`
+		AllowHosts []string `yaml:"allow_hosts,omitempty,flow"`
+		DenyHosts  []string `yaml:"deny_hosts,omitempty,flow"`
+	} `yaml:"targets"`
+	Chains struct {
+		Hosts    []string `yaml:"hosts,omitempty,flow"`
+		MaxDepth int      `yaml:"max_depth"`
+		Mode     string   `yaml:"mode"`
+	} `yaml:"chains"`
+	Admin struct {
+		Addr  string `yaml:"addr,omitempty"`
+		Token string `yaml:"token,omitempty"`
+	} `yaml:"admin"`
+	Fallback struct {
+		Mode string `yaml:"mode"`
+		URL  string `yaml:"url,omitempty"`
+	} `yaml:"fallback"`
+	AccessLog struct {
+		Output string `yaml:"output,omitempty"`
+		Format string `yaml:"format"`
+	} `yaml:"access_log"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+// Storage backends and fallback modes.
+const (
+	storeDemo = "demo" // the rules built into the binary
+	storeFile = "file"
+	storeBolt = "bolt"
+
+	fallbackSuggest  = "suggest" // a 404 page listing the closest links
+	fallbackDemo     = "demo"    // a few built-in links, then "Hello, world!"
+	fallbackNotFound = "not_found"
+	fallbackRedirect = "redirect"
+)
+
+func defaultConfig() config {
+	var c config
+	c.Addr = ":8080"
+	c.Store.Backend = storeDemo
+	c.Status = 302
+	c.Chains.MaxDepth = 3
+	c.Chains.Mode = string(urlshort.ChainReject)
+	c.Fallback.Mode = fallbackSuggest
+	c.AccessLog.Format = "json"
+	c.ShutdownTimeout = 30 * time.Second
+	return c
+}
+
+// setting is a configuration value settable by flag and
+// environment variable.
+type setting struct {
+	flag, env, usage string
+	set              func(c *config, s string) error
+}
+
+func stringSetting(p func(c *config) *string) func(*config, string) error {
+	return func(c *config, s string) error {
+		*p(c) = s
+		return nil
+	}
+}
+
+// listSetting sets a list given as comma-separated values.
+func listSetting(p func(c *config) *[]string) func(*config, string) error {
+	return func(c *config, s string) error {
+		var list []string
+		for _, v := range strings.Split(s, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				list = append(list, v)
+			}
+		}
+		*p(c) = list
+		return nil
+	}
+}
+
+var settings = []setting{
+	{"addr", "URLSHORT_ADDR", "address to listen on (default :8080)",
+		stringSetting(func(c *config) *string { return &c.Addr })},
+	{"tls-cert", "URLSHORT_TLS_CERT", "TLS certificate file; serve HTTPS when set with -tls-key",
+		stringSetting(func(c *config) *string { return &c.TLS.Cert })},
+	{"tls-key", "URLSHORT_TLS_KEY", "TLS private key file",
+		stringSetting(func(c *config) *string { return &c.TLS.Key })},
+	{"store", "URLSHORT_STORE", "storage backend: demo, file or bolt (default demo)",
+		stringSetting(func(c *config) *string { return &c.Store.Backend })},
+	{"dsn", "URLSHORT_DSN", "rules file for the file backend, database for the bolt backend",
+		stringSetting(func(c *config) *string { return &c.Store.DSN })},
+	{"file", "", "YAML or JSON file with path/url rules, reloaded whenever it changes; short for -store file -dsn FILE",
+		func(c *config, s string) error {
+			c.Store.Backend, c.Store.DSN = storeFile, s
+			return nil
+		}},
+	{"db", "", "BoltDB database with the rules; short for -store bolt -dsn DB",
+		func(c *config, s string) error {
+			c.Store.Backend, c.Store.DSN = storeBolt, s
+			return nil
+		}},
+	{"status", "URLSHORT_STATUS", "default redirect status code (default 302)",
+		func(c *config, s string) error {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return fmt.Errorf("invalid status %q", s)
+			}
+			c.Status = n
+			return nil
+		}},
+	{"normalize-paths", "URLSHORT_NORMALIZE_PATHS", `how paths are normalized before matching: "all", "none", or a comma-separated list of case, trailing_slash, slashes and unreserved (default none)`,
+		stringSetting(func(c *config) *string { return &c.NormalizePaths })},
+	{"allow-schemes", "URLSHORT_ALLOW_SCHEMES", `comma-separated URL schemes links may redirect to, "*" for any (default http,https)`,
+		listSetting(func(c *config) *[]string { return &c.Targets.Schemes })},
+	{"allow-hosts", "URLSHORT_ALLOW_HOSTS", `comma-separated hosts links may only redirect to; "*.example.com" covers the subdomains of example.com`,
+		listSetting(func(c *config) *[]string { return &c.Targets.AllowHosts })},
+	{"deny-hosts", "URLSHORT_DENY_HOSTS", "comma-separated hosts links may not redirect to",
+		listSetting(func(c *config) *[]string { return &c.Targets.DenyHosts })},
+	{"own-hosts", "URLSHORT_OWN_HOSTS", "comma-separated hosts the server answers to, so links redirecting to them are followed to catch loops",
+		listSetting(func(c *config) *[]string { return &c.Chains.Hosts })},
+	{"max-chain", "URLSHORT_MAX_CHAIN", "most redirects through the server's own links a visitor may be sent through (default 3)",
+		func(c *config, s string) error {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return fmt.Errorf("invalid chain depth %q", s)
+			}
+			c.Chains.MaxDepth = n
+			return nil
+		}},
+	{"chain-mode", "URLSHORT_CHAIN_MODE", "what to do with redirect loops and long chains: reject, warn or collapse (default reject)",
+		stringSetting(func(c *config) *string { return &c.Chains.Mode })},
+	{"admin-addr", "URLSHORT_ADMIN_ADDR", "address to serve the admin API on, apart from the links",
+		stringSetting(func(c *config) *string { return &c.Admin.Addr })},
+	{"admin-token", "URLSHORT_ADMIN_TOKEN", "token the admin API requires; without -admin-addr, the API is served next to the links",
+		stringSetting(func(c *config) *string { return &c.Admin.Token })},
+	{"fallback", "URLSHORT_FALLBACK", "what to do with unknown paths: suggest, demo, not_found or redirect (default suggest)",
+		stringSetting(func(c *config) *string { return &c.Fallback.Mode })},
+	{"fallback-url", "URLSHORT_FALLBACK_URL", "where the redirect fallback sends unknown paths",
+		stringSetting(func(c *config) *string { return &c.Fallback.URL })},
+	{"access-log", "URLSHORT_ACCESS_LOG", `where to log requests: "-" for standard output, "syslog", or a file path, rotated at 100MB`,
+		stringSetting(func(c *config) *string { return &c.AccessLog.Output })},
+	{"access-log-format", "URLSHORT_ACCESS_LOG_FORMAT", "access log format: json or logfmt (default json)",
+		stringSetting(func(c *config) *string { return &c.AccessLog.Format })},
+	{"shutdown-timeout", "URLSHORT_SHUTDOWN_TIMEOUT", "how long to wait for requests in flight when stopping (default 30s)",
+		func(c *config, s string) error {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return fmt.Errorf("invalid shutdown timeout %q", s)
+			}
+			c.ShutdownTimeout = d
+			return nil
+		}},
+}
+
+// loadConfig builds the configuration from the command line
+// arguments and the environment, looked up with getenv. It
+// reports whether -print-config was given.
+func loadConfig(args []string, getenv func(string) string) (config, bool, error) {
+	fs := flag.NewFlagSet("urlshort", flag.ContinueOnError)
+	path := fs.String("config", getenv("URLSHORT_CONFIG"), "YAML or JSON config file (env URLSHORT_CONFIG)")
+	printConfig := fs.Bool("print-config", false, "print the effective configuration and exit")
+	// Flags are applied last, in the order they were given.
+	type flagValue struct {
+		s    *setting
+		text string
+	}
+	var given []flagValue
+	for i := range settings {
+		s := &settings[i]
+		usage := s.usage
+		if s.env != "" {
+			usage += " (env " + s.env + ")"
+		}
+		fs.Func(s.flag, usage, func(text string) error {
+			given = append(given, flagValue{s, text})
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return config{}, false, err
+	}
+	if fs.NArg() > 0 {
+		return config{}, false, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	c := defaultConfig()
+	if *path != "" {
+		data, err := ioutil.ReadFile(*path)
+		if err != nil {
+			return config{}, false, err
+		}
+		if err := yaml.UnmarshalStrict(data, &c); err != nil {
+			return config{}, false, fmt.Errorf("%s: %v", *path, err)
+		}
+	}
+	for i := range settings {
+		s := &settings[i]
+		if s.env == "" {
+			continue
+		}
+		if v := getenv(s.env); v != "" {
+			if err := s.set(&c, v); err != nil {
+				return config{}, false, fmt.Errorf("%s: %v", s.env, err)
+			}
+		}
+	}
+	for _, v := range given {
+		if err := v.s.set(&c, v.text); err != nil {
+			return config{}, false, fmt.Errorf("-%s: %v", v.s.flag, err)
+		}
+	}
+	return c, *printConfig, c.check()
+}
+
+// check reports settings that are invalid or do not go together.
+// The status code and the chain settings are checked by the
+// handler.
+func (c config) check() error {
+	switch c.Store.Backend {
+	case storeDemo:
+	case storeFile, storeBolt:
+		if c.Store.DSN == "" {
+			return fmt.Errorf("the %s store needs a dsn", c.Store.Backend)
+		}
+	default:
+		return fmt.Errorf("unknown store %q", c.Store.Backend)
+	}
+	switch c.Fallback.Mode {
+	case fallbackSuggest, fallbackDemo, fallbackNotFound:
+	case fallbackRedirect:
+		if c.Fallback.URL == "" {
+			return errors.New("the redirect fallback needs a url")
+		}
+	default:
+		return fmt.Errorf("unknown fallback %q", c.Fallback.Mode)
+	}
+	if _, err := urlshort.ParsePathNorm(c.NormalizePaths); err != nil {
+		return err
+	}
+	if c.Admin.Addr != "" && c.Admin.Addr == c.Addr {
+		return errors.New("the admin API needs an address of its own")
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return errors.New("TLS needs both a certificate and a key")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("the shutdown timeout must be positive")
+	}
+	return nil
+}
+
+// ruleOptions returns the handler options for the rule settings,
+// which can change while the server runs.
+func (c config) ruleOptions() ([]urlshort.Option, error) {
+	norm, err := urlshort.ParsePathNorm(c.NormalizePaths)
+	if err != nil {
+		return nil, err
+	}
+	return []urlshort.Option{
+		urlshort.WithPathNorm(norm),
+		urlshort.WithTargetPolicy(urlshort.TargetPolicy{
+			Schemes:    c.Targets.Schemes,
+			AllowHosts: c.Targets.AllowHosts,
+			DenyHosts:  c.Targets.DenyHosts,
+		}),
+		urlshort.WithChainPolicy(urlshort.ChainPolicy{
+			Hosts:    c.Chains.Hosts,
+			MaxDepth: c.Chains.MaxDepth,
+			Mode:     urlshort.ChainMode(c.Chains.Mode),
+		}),
+	}, nil
+}
+
+// print writes the configuration to w as YAML, without the
+// admin token.
+func (c config) print(w io.Writer) error {
+	if c.Admin.Token != "" {
+		c.Admin.Token = "<redacted>"
+	}
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// env returns a getenv looking up vars.
+func env(vars map[string]string) func(string) string {
+	return func(key string) string { return vars[key] }
+}
+
+// writeConfig writes data to a config file and returns its path.
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "urlshort.yaml")
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigDefaults(t *testing.T) {
+	c, printConfig, err := loadConfig(nil, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if printConfig {
+		t.Error("printConfig set without -print-config")
+	}
+	if c.Addr != ":8080" || c.Store.Backend != storeDemo || c.Status != 302 ||
+		c.Fallback.Mode != fallbackSuggest || c.ShutdownTimeout != 30*time.Second ||
+		c.Chains.MaxDepth != 3 || c.Chains.Mode != "reject" {
+		t.Errorf("defaults = %+v", c)
+	}
+	if c.Admin.Addr != "" || c.Admin.Token != "" {
+		t.Errorf("admin API on by default: %+v", c.Admin)
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := writeConfig(t, `
+addr: ":1"
+status: 301
+fallback: {mode: not_found}
+targets: {allow_hosts: [file.example]}
+`)
+	vars := map[string]string{
+		"URLSHORT_CONFIG":       path,
+		"URLSHORT_STATUS":       "307",
+		"URLSHORT_FALLBACK":     "redirect",
+		"URLSHORT_FALLBACK_URL": "https://env.example",
+	}
+	c, _, err := loadConfig([]string{"-status", "308", "-addr", ":2", "-addr", ":3"}, env(vars))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flags win over the environment, which wins over the file,
+	// which wins over the defaults; the last of repeated flags
+	// wins.
+	if c.Status != 308 {
+		t.Errorf("status = %d, want the flag's 308", c.Status)
+	}
+	if c.Addr != ":3" {
+		t.Errorf("addr = %q, want the last flag's :3", c.Addr)
+	}
+	if c.Fallback.Mode != fallbackRedirect || c.Fallback.URL != "https://env.example" {
+		t.Errorf("fallback = %+v, want the environment's", c.Fallback)
+	}
+	if len(c.Targets.AllowHosts) != 1 || c.Targets.AllowHosts[0] != "file.example" {
+		t.Errorf("allow_hosts = %v, want the file's", c.Targets.AllowHosts)
+	}
+	if c.ShutdownTimeout != 30*time.Second {
+		t.Errorf("shutdown timeout = %v, want the default", c.ShutdownTimeout)
+	}
+
+	// -config wins over URLSHORT_CONFIG.
+	other := writeConfig(t, "status: 303\n")
+	if c, _, err := loadConfig([]string{"-config", other}, env(map[string]string{"URLSHORT_CONFIG": path})); err != nil || c.Status != 303 {
+		t.Errorf("-config: status = %d, %v, want 303", c.Status, err)
+	}
+
+	// Lists are comma-separated.
+	c, _, err = loadConfig([]string{"-allow-hosts", "a.example, *.b.example,"}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(c.Targets.AllowHosts, " "); got != "a.example *.b.example" {
+		t.Errorf("allow_hosts = %q", got)
+	}
+}
+
+func TestConfigShorthands(t *testing.T) {
+	c, _, err := loadConfig([]string{"-file", "links.yaml"}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Store.Backend != storeFile || c.Store.DSN != "links.yaml" {
+		t.Errorf("-file: store = %+v", c.Store)
+	}
+	c, _, err = loadConfig([]string{"-db", "links.db"}, env(map[string]string{"URLSHORT_STORE": "file", "URLSHORT_DSN": "env.yaml"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Store.Backend != storeBolt || c.Store.DSN != "links.db" {
+		t.Errorf("-db: store = %+v", c.Store)
+	}
+	// Flags apply in order, so a later -dsn overrides -file's.
+	c, _, err = loadConfig([]string{"-file", "a.yaml", "-dsn", "b.yaml"}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Store.Backend != storeFile || c.Store.DSN != "b.yaml" {
+		t.Errorf("-file then -dsn: store = %+v", c.Store)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		file string
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{name: "unknown key", file: "adress: \":1\"\n", want: "adress"},
+		{name: "unknown nested key", file: "store: {backend: file, path: x}\n", want: "path"},
+		{name: "unknown store", args: []string{"-store", "sql"}, want: `unknown store "sql"`},
+		{name: "store without dsn", args: []string{"-store", "bolt"}, want: "needs a dsn"},
+		{name: "unknown fallback", args: []string{"-fallback", "teapot"}, want: `unknown fallback "teapot"`},
+		{name: "redirect without url", args: []string{"-fallback", "redirect"}, want: "needs a url"},
+		{name: "bad normalization", args: []string{"-normalize-paths", "upper"}, want: "upper"},
+		{name: "half of TLS", args: []string{"-tls-cert", "server.crt"}, want: "both a certificate and a key"},
+		{name: "shared admin address", args: []string{"-admin-addr", ":8080"}, want: "address of its own"},
+		{name: "bad timeout", args: []string{"-shutdown-timeout", "0s"}, want: "must be positive"},
+		{name: "bad status", env: map[string]string{"URLSHORT_STATUS": "moved"}, want: `URLSHORT_STATUS: invalid status "moved"`},
+		{name: "bad chain depth", args: []string{"-max-chain", "deep"}, want: `-max-chain: invalid chain depth "deep"`},
+		{name: "arguments", args: []string{"links.yaml"}, want: "unexpected arguments: links.yaml"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeConfig(t, tt.file)}, args...)
+			}
+			_, _, err := loadConfig(args, env(tt.env))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want one mentioning %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	c, printConfig, err := loadConfig([]string{"-print-config", "-status", "301", "-admin-token", "s3cret"}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !printConfig {
+		t.Fatal("printConfig not set")
+	}
+	var buf bytes.Buffer
+	if err := c.print(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "s3cret") {
+		t.Errorf("printed the admin token:\n%s", buf.String())
+	}
+	// The output is a config file giving the same settings.
+	var back config
+	if err := yaml.UnmarshalStrict(buf.Bytes(), &back); err != nil {
+		t.Fatalf("%v:\n%s", err, buf.String())
+	}
+	if back.Status != 301 || back.Addr != c.Addr || back.Fallback.Mode != c.Fallback.Mode || back.ShutdownTimeout != c.ShutdownTimeout {
+		t.Errorf("printed %+v, want %+v", back, c)
+	}
+}
@@ -1,36 +1,290 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
 
 	"github.com/gophercises/urlshort"
+	yaml "gopkg.in/yaml.v2"
 )
 
 func main() {
-	mux := defaultMux()
+	cfg, printConfig, err := loadConfig(os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if printConfig {
+		if err := cfg.print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	reconfig := func() (config, error) {
+		c, _, err := loadConfig(os.Args[1:], os.Getenv)
+		return c, err
+	}
+	if err := run(cfg, reconfig); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	// Build the MapHandler using the mux as the fallback
-	pathsToUrls := map[string]string{
-		"/urlshort-godoc": "https://godoc.org/github.com/gophercises/urlshort",
-		"/yaml-godoc":     "https://godoc.org/gopkg.in/yaml.v2",
+// run serves until SIGINT or SIGTERM, then waits for the
+// requests in flight and releases everything it opened, in
+// reverse order. SIGHUP reloads the rules, and the rule settings
+// of the configuration returned by reconfig: path normalization,
+// target and chain policies. Other settings need a restart.
+func run(cfg config, reconfig func() (config, error)) error {
+	// fallback returns the handler for unknown paths of table.
+	// createURL is where its suggestion page posts new links.
+	fallback := func(table *urlshort.Table, createURL string) http.Handler {
+		switch cfg.Fallback.Mode {
+		case fallbackNotFound:
+			return http.NotFoundHandler()
+		case fallbackRedirect:
+			return http.RedirectHandler(cfg.Fallback.URL, http.StatusFound)
+		case fallbackSuggest:
+			return urlshort.SuggestHandler(table, createURL)
+		}
+		mux := defaultMux()
+
+		// Build the MapHandler using the mux as the fallback
+		pathsToUrls := map[string]string{
+			"/urlshort-godoc": "https://godoc.org/github.com/gophercises/urlshort",
+			"/yaml-godoc":     "https://godoc.org/gopkg.in/yaml.v2",
+		}
+		return urlshort.MapHandler(pathsToUrls, mux)
+	}
+	rules, err := cfg.ruleOptions()
+	if err != nil {
+		return err
 	}
-	mapHandler := urlshort.MapHandler(pathsToUrls, mux)
+	opts := append([]urlshort.Option{urlshort.WithStatus(cfg.Status)}, rules...)
+
+	// The status endpoints are served next to the redirects, so
+	// they do not count as misses. The admin API is served there
+	// too when it only has a token to guard it, and so can the
+	// suggestion page's form to create links.
+	server := http.NewServeMux()
+	admin := server
+	createURL := ""
+	if cfg.Admin.Addr != "" {
+		admin = http.NewServeMux()
+	} else if cfg.Admin.Token != "" {
+		createURL = urlshort.APIPrefix
+	}
+	var (
+		handler http.Handler
+		table   *urlshort.Table
+		metrics *urlshort.Metrics
+		reload  = func() error { return nil }
+	)
+	if cfg.Store.Backend != storeDemo {
+		var (
+			store urlshort.Store
+			err   error
+		)
+		if cfg.Store.Backend == storeBolt {
+			bs, err := urlshort.OpenBoltStore(cfg.Store.DSN, 0600)
+			if err != nil {
+				return err
+			}
+			defer bs.Close()
+			store = bs
+			if table, err = urlshort.LoadTable(store); err != nil {
+				return err
+			}
+			reload = table.Reload
+		} else {
+			// Serve the rules in the file and keep them in sync
+			// with it.
+			fs, err := urlshort.OpenFileStore(cfg.Store.DSN)
+			if err != nil {
+				return err
+			}
+			store = fs
+			if table, err = urlshort.LoadTable(store); err != nil {
+				return err
+			}
+			watcher := urlshort.WatchFile(fs, table, 2*time.Second, nil)
+			defer watcher.Close()
+			server.Handle("/_status/reload", watcher)
+			reload = watcher.Reload
+		}
+		sweeper := urlshort.SweepExpired(store, table, time.Minute, nil)
+		defer sweeper.Close()
+		metrics = urlshort.NewMetrics(table)
+
+		// Manage the links through the admin API.
+		if cfg.Admin.Addr != "" || cfg.Admin.Token != "" {
+			api := urlshort.NewAPI(store, table)
+			api.Token = cfg.Admin.Token
+			admin.Handle(urlshort.APIPrefix, api)
+			admin.Handle(urlshort.APIPrefix+"/", api)
+		}
+
+		// Record hits in the background, if the store keeps them.
+		// Closing the recorder writes the pending ones.
+		if hs, ok := store.(urlshort.HitStore); ok {
+			recorder := urlshort.NewRecorder(hs, urlshort.RecorderConfig{})
+			defer recorder.Close()
+			opts = append(opts, urlshort.WithRecorder(recorder))
+			metrics.Recorder = recorder
+		}
 
-	// Build the YAMLHandler using the mapHandler as the
-	// fallback
-	yaml := `
+		handler, err = urlshort.TableHandler(table, fallback(table, createURL), opts...)
+		if err != nil {
+			return err
+		}
+	} else {
+		// Serve the rules built into the binary, which cannot be
+		// changed.
+		yml := `
 - path: /urlshort
   url: https://github.com/gophercises/urlshort
 - path: /urlshort-final
   url: https://github.com/gophercises/urlshort/tree/solution
 `
-	yamlHandler, err := urlshort.YAMLHandler([]byte(yaml), mapHandler)
+		var links []urlshort.Link
+		if err := yaml.Unmarshal([]byte(yml), &links); err != nil {
+			return err
+		}
+		if table, err = urlshort.NewTable(links); err != nil {
+			return err
+		}
+		if handler, err = urlshort.TableHandler(table, fallback(table, ""), opts...); err != nil {
+			return err
+		}
+		metrics = urlshort.NewMetrics(table)
+	}
+	handler = metrics.Instrument(handler)
+	if cfg.AccessLog.Output != "" {
+		var out io.Writer
+		switch cfg.AccessLog.Output {
+		case "-":
+			out = os.Stdout
+		case "syslog":
+			w, err := urlshort.DialSyslog("urlshort")
+			if err != nil {
+				return err
+			}
+			defer w.Close()
+			out = w
+		default:
+			f, err := urlshort.OpenRotatingFile(cfg.AccessLog.Output, 100<<20, 5)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+		al, err := urlshort.NewAccessLog(out, urlshort.AccessLogConfig{
+			Format:      urlshort.LogFormat(cfg.AccessLog.Format),
+			SampleAfter: 100,
+		})
+		if err != nil {
+			return err
+		}
+		handler = al.Instrument(handler)
+	}
+	server.Handle("/metrics", metrics)
+	server.Handle("/", handler)
+
+	servers := []*http.Server{newServer(cfg.Addr, server)}
+	if cfg.Admin.Addr != "" {
+		servers = append(servers, newServer(cfg.Admin.Addr, admin))
+	}
+	errc := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			if cfg.TLS.Cert != "" {
+				errc <- srv.ListenAndServeTLS(cfg.TLS.Cert, cfg.TLS.Key)
+			} else {
+				errc <- srv.ListenAndServe()
+			}
+		}(srv)
+		fmt.Println("Starting the server on", srv.Addr)
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigc)
+	for {
+		select {
+		case err := <-errc:
+			return err
+		case sig := <-sigc:
+			if sig == syscall.SIGHUP {
+				if next, err := reconfig(); err != nil {
+					log.Printf("config reload failed: %v", err)
+				} else if err := applyConfig(table, &cfg, next); err != nil {
+					log.Printf("config reload failed: %v", err)
+				}
+				if err := reload(); err != nil {
+					log.Printf("reload failed: %v", err)
+				} else {
+					log.Print("reloaded")
+				}
+				continue
+			}
+			log.Printf("%v: shutting down", sig)
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+			defer cancel()
+			for _, srv := range servers {
+				if err := srv.Shutdown(ctx); err != nil {
+					return err
+				}
+			}
+			for range servers {
+				if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+}
+
+// applyConfig applies the rule settings of next to table and
+// cfg, and warns about the other settings that changed, which
+// need a restart.
+func applyConfig(table *urlshort.Table, cfg *config, next config) error {
+	rules, err := next.ruleOptions()
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if err := table.Configure(rules...); err != nil {
+		return err
+	}
+	cfg.NormalizePaths, cfg.Targets, cfg.Chains = next.NormalizePaths, next.Targets, next.Chains
+	if !reflect.DeepEqual(*cfg, next) {
+		log.Print("config changed; restart to apply the changes other than to normalize_paths, targets and chains")
+	}
+	return nil
+}
+
+// newServer returns a server for handler listening on addr.
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
 	}
-	fmt.Println("Starting the server on :8080")
-	http.ListenAndServe(":8080", yamlHandler)
 }
 
 func defaultMux() *http.ServeMux {
@@ -0,0 +1,142 @@
+package urlshort
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// lookupBuckets are the upper bounds, in seconds, of the lookup
+// latency histogram. Lookups are in memory, so they start low.
+var lookupBuckets = []float64{1e-6, 5e-6, 1e-5, 5e-5, 1e-4, 5e-4, 1e-3, 5e-3, 1e-2, 5e-2, 0.1}
+
+// Metrics collects metrics about the requests served by the
+// handlers it instruments, and serves them in the Prometheus
+// text exposition format:
+//
+//     urlshort_redirects_total{code="302"}       redirects, by status
+//     urlshort_misses_total                      requests passed to the fallback
+//     urlshort_lookup_duration_seconds           histogram of rule lookups
+//     urlshort_store_errors_total                store errors while serving
+//     urlshort_hits_dropped_total                hits dropped by the recorder
+//     urlshort_hits_failed_total                 hits lost to store errors
+//     urlshort_reloads_total{result="success"}   reloads of the table
+//     urlshort_links                             links in the table
+//
+// The hits need Recorder to be set. The last two need a Table;
+// reloads are reported for tables created by LoadTable, whether
+// they are reloaded by a Watcher or by calling Reload.
+type Metrics struct {
+	// Recorder, if set, is the recorder whose lost hits are
+	// reported. Set it before serving the metrics.
+	Recorder *Recorder
+
+	table *Table
+
+	// All counters are updated atomically.
+	redirects   [100]uint64 // by status code - 300
+	misses      uint64
+	storeErrors uint64
+	lookups     []uint64 // per bucket, and +Inf last
+	lookupNanos uint64
+}
+
+// NewMetrics returns a Metrics reporting the size and the
+// reloads of table, which may be nil.
+func NewMetrics(table *Table) *Metrics {
+	return &Metrics{
+		table:   table,
+		lookups: make([]uint64, len(lookupBuckets)+1),
+	}
+}
+
+// Instrument returns a handler serving requests with next, which
+// should be or wrap handlers created by this package, and
+// counting them.
+func (m *Metrics) Instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, info := withRequestInfo(r)
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		m.observe(info, sw.status)
+	})
+}
+
+func (m *Metrics) observe(info *requestInfo, status int) {
+	switch info.outcome {
+	case "":
+		// Not served by a handler of this package.
+		return
+	case outcomeRedirect:
+		if status >= 300 && status < 400 {
+			atomic.AddUint64(&m.redirects[status-300], 1)
+		}
+	case outcomeMiss:
+		atomic.AddUint64(&m.misses, 1)
+	}
+	if info.storeErr {
+		atomic.AddUint64(&m.storeErrors, 1)
+	}
+	i := 0
+	for i < len(lookupBuckets) && info.lookup.Seconds() > lookupBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&m.lookups[i], 1)
+	atomic.AddUint64(&m.lookupNanos, uint64(info.lookup))
+}
+
+// ServeHTTP writes the metrics.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	writeMetricHeader(bw, "urlshort_redirects_total", "counter", "Redirects served, by status code.")
+	for i := range m.redirects {
+		if n := atomic.LoadUint64(&m.redirects[i]); n > 0 {
+			fmt.Fprintf(bw, "urlshort_redirects_total{code=\"%d\"} %d\n", 300+i, n)
+		}
+	}
+	writeMetricHeader(bw, "urlshort_misses_total", "counter", "Requests matching no link, passed to the fallback handler.")
+	fmt.Fprintf(bw, "urlshort_misses_total %d\n", atomic.LoadUint64(&m.misses))
+
+	writeMetricHeader(bw, "urlshort_lookup_duration_seconds", "histogram", "Time spent looking up routing rules.")
+	var count uint64
+	for i, le := range lookupBuckets {
+		count += atomic.LoadUint64(&m.lookups[i])
+		fmt.Fprintf(bw, "urlshort_lookup_duration_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(le, 'g', -1, 64), count)
+	}
+	count += atomic.LoadUint64(&m.lookups[len(lookupBuckets)])
+	fmt.Fprintf(bw, "urlshort_lookup_duration_seconds_bucket{le=\"+Inf\"} %d\n", count)
+	sum := time.Duration(atomic.LoadUint64(&m.lookupNanos)).Seconds()
+	fmt.Fprintf(bw, "urlshort_lookup_duration_seconds_sum %s\n", strconv.FormatFloat(sum, 'g', -1, 64))
+	fmt.Fprintf(bw, "urlshort_lookup_duration_seconds_count %d\n", count)
+
+	writeMetricHeader(bw, "urlshort_store_errors_total", "counter", "Store errors while serving requests.")
+	fmt.Fprintf(bw, "urlshort_store_errors_total %d\n", atomic.LoadUint64(&m.storeErrors))
+
+	if m.Recorder != nil {
+		writeMetricHeader(bw, "urlshort_hits_dropped_total", "counter", "Hits dropped because the recorder's queue was full.")
+		fmt.Fprintf(bw, "urlshort_hits_dropped_total %d\n", m.Recorder.Dropped())
+		writeMetricHeader(bw, "urlshort_hits_failed_total", "counter", "Hits lost to store errors.")
+		fmt.Fprintf(bw, "urlshort_hits_failed_total %d\n", m.Recorder.Failed())
+	}
+
+	if m.table != nil && m.table.store != nil {
+		succeeded, failed := m.table.Reloads()
+		writeMetricHeader(bw, "urlshort_reloads_total", "counter", "Reloads of the links from the store, by result.")
+		fmt.Fprintf(bw, "urlshort_reloads_total{result=\"success\"} %d\n", succeeded)
+		fmt.Fprintf(bw, "urlshort_reloads_total{result=\"failure\"} %d\n", failed)
+	}
+	if m.table != nil {
+		writeMetricHeader(bw, "urlshort_links", "gauge", "Links in the routing table.")
+		fmt.Fprintf(bw, "urlshort_links %d\n", m.table.Len())
+	}
+}
+
+func writeMetricHeader(w *bufio.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
@@ -0,0 +1,103 @@
+package urlshort
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	store := NewMemoryStore([]Link{
+		{Path: "/a", URL: "https://a.example"},
+		{Path: "/b", URL: "https://b.example", Status: 301},
+		{Path: "/c", URL: "https://c.example", MaxClicks: 1},
+	})
+	table, err := LoadTable(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := TableHandler(table, http.HandlerFunc(fallback))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMetrics(table)
+	ih := m.Instrument(h)
+	for _, path := range []string{"/a", "/a", "/b", "/c", "/c", "/missing"} {
+		ih.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE urlshort_redirects_total counter\n",
+		`urlshort_redirects_total{code="302"} 3` + "\n",
+		`urlshort_redirects_total{code="301"} 1` + "\n",
+		"urlshort_misses_total 1\n",
+		`urlshort_lookup_duration_seconds_bucket{le="+Inf"} 6` + "\n",
+		"urlshort_lookup_duration_seconds_count 6\n",
+		"urlshort_store_errors_total 0\n",
+		"urlshort_links 3\n",
+		`urlshort_reloads_total{result="success"} 0` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %q:\n%s", want, body)
+		}
+	}
+
+	// Reloads are counted without a Watcher, and failures too.
+	if err := table.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(Link{Path: "/d", URL: "ftp://d.example"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.Reload(); err == nil {
+		t.Fatal("reloaded an invalid link")
+	}
+	rec = httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body = rec.Body.String()
+	for _, want := range []string{
+		`urlshort_reloads_total{result="success"} 1` + "\n",
+		`urlshort_reloads_total{result="failure"} 1` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %q:\n%s", want, body)
+		}
+	}
+
+	// The hits lost by a recorder are reported once it is set.
+	if strings.Contains(body, "urlshort_hits_dropped_total") {
+		t.Error("hits reported without a recorder")
+	}
+	recorder := NewRecorder(failingSink{}, RecorderConfig{Logger: log.New(ioutil.Discard, "", 0)})
+	recorder.Record("/a", httptest.NewRequest(http.MethodGet, "/a", nil))
+	recorder.Close()
+	m.Recorder = recorder
+	rec = httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body = rec.Body.String()
+	for _, want := range []string{
+		"urlshort_hits_dropped_total 0\n",
+		"urlshort_hits_failed_total 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %q:\n%s", want, body)
+		}
+	}
+
+	// Tables that cannot reload report no reloads.
+	table, err = NewTable(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	NewMetrics(table).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if strings.Contains(rec.Body.String(), "urlshort_reloads_total") {
+		t.Error("reloads reported for a table without a store")
+	}
+}
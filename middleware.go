@@ -0,0 +1,98 @@
+package urlshort
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Outcomes of a request, as reported to middleware.
+const (
+	outcomeRedirect  = "redirect"
+	outcomeMiss      = "miss" // served by the fallback
+	outcomeExpired   = "expired"
+	outcomeExhausted = "exhausted"
+	outcomeLocked    = "locked" // password form shown
+	outcomeError     = "error"
+)
+
+// requestInfo is what a handler learnt about a request, for the
+// middleware observing it. Its methods do nothing on a nil
+// receiver, so handlers can report to it unconditionally.
+type requestInfo struct {
+	link     string        // path of the matched link
+	outcome  string        // one of the outcome constants
+	lookup   time.Duration // time spent looking up rules
+	storeErr bool
+}
+
+type requestInfoKey struct{}
+
+// withRequestInfo returns r with a new requestInfo attached for
+// the handlers serving it to fill in.
+func withRequestInfo(r *http.Request) (*http.Request, *requestInfo) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		// Already observed by an outer middleware.
+		return r, info
+	}
+	info := &requestInfo{}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)), info
+}
+
+func requestInfoFrom(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// lookedUp records a rule lookup that took d. Handlers nest, as
+// when one is the fallback of another, so lookups add up.
+func (i *requestInfo) lookedUp(d time.Duration) {
+	if i != nil {
+		i.lookup += d
+	}
+}
+
+// served records the outcome of the request. The innermost
+// handler reports last, so its outcome wins.
+func (i *requestInfo) served(outcome, link string) {
+	if i != nil {
+		i.outcome, i.link = outcome, link
+	}
+}
+
+func (i *requestInfo) failed() {
+	if i != nil {
+		i.storeErr = true
+	}
+}
+
+// statusWriter is an http.ResponseWriter remembering the status
+// and size of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher when the underlying writer does.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,75 @@
+package urlshort
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// NormalizeURL returns a canonical form of rawurl, so that URLs
+// that differ only in ways that do not matter compare equal:
+// the scheme and host are lower-cased, default ports are
+// removed, a trailing slash is dropped from the path and query
+// parameters are sorted.
+func NormalizeURL(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	host, port := u.Hostname(), u.Port()
+	host = strings.ToLower(host)
+	if port == "80" && u.Scheme == "http" || port == "443" && u.Scheme == "https" {
+		port = ""
+	}
+	switch {
+	case port != "":
+		u.Host = net.JoinHostPort(host, port)
+	case strings.Contains(host, ":"):
+		u.Host = "[" + host + "]"
+	default:
+		u.Host = host
+	}
+	if len(u.Path) > 1 {
+		u.Path = strings.TrimRight(u.Path, "/")
+		u.RawPath = ""
+	}
+	if u.Path == "" && u.Host != "" {
+		u.Path = "/"
+	}
+	if u.RawQuery != "" {
+		if q, err := url.ParseQuery(u.RawQuery); err == nil {
+			u.RawQuery = q.Encode()
+		}
+	}
+	return u.String(), nil
+}
+
+// URLIndex is implemented by stores that keep a reverse index
+// from normalized target URLs to the links pointing there.
+type URLIndex interface {
+	// LookupURL returns a link of owner on host whose URL
+	// normalizes to the same value as rawurl, or ErrNotFound.
+	// Links that have expired or used up their clicks do not
+	// count.
+	LookupURL(owner, host, rawurl string) (Link, error)
+}
+
+// urlKey returns the reverse index key for l, or false if l is
+// not indexed: patterns are not, since their URLs are templates.
+// The host comes last, so that the keys of links of the default
+// domain are the same as before hosts existed.
+func urlKey(l Link) (string, bool) {
+	if strings.HasSuffix(l.Path, wildcard) || strings.Contains(l.Path, "/"+string(paramMarker)) {
+		return "", false
+	}
+	n, err := NormalizeURL(l.URL)
+	if err != nil {
+		return "", false
+	}
+	key := l.Owner + "\x00" + n
+	if l.Host != "" {
+		key += "\x01" + l.Host
+	}
+	return key, true
+}
@@ -0,0 +1,65 @@
+package urlshort
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNormalizeURL(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"HTTPS://Example.COM:443/a/b/?z=1&a=2", "https://example.com/a/b?a=2&z=1"},
+		{"http://example.com:80", "http://example.com/"},
+		{"http://example.com:8080/", "http://example.com:8080/"},
+		{"https://example.com/Path#frag", "https://example.com/Path#frag"},
+		{"http://[::1]:80/x/", "http://[::1]/x"},
+	}
+	for _, tt := range tests {
+		got, err := NormalizeURL(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("NormalizeURL(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestURLIndex(t *testing.T) {
+	for name, open := range storeFactories {
+		t.Run(name, func(t *testing.T) {
+			s := open(t, t.TempDir())
+			idx, ok := s.(URLIndex)
+			if !ok {
+				t.Fatalf("%T does not implement URLIndex", s)
+			}
+			s.Put(Link{Path: "/b", URL: "https://example.com/x/?b=2&a=1", Owner: "ci"})
+			s.Put(Link{Path: "/a", URL: "https://EXAMPLE.com:443/x?a=1&b=2", Owner: "ci"})
+			s.Put(Link{Path: "/g/*", URL: "https://example.com/x?a=1&b=2", Owner: "ci"})
+
+			if l, err := idx.LookupURL("ci", "", "https://example.com/x?a=1&b=2"); err != nil || l.Path != "/a" {
+				t.Errorf("LookupURL = %+v, %v, want /a", l, err)
+			}
+			if _, err := idx.LookupURL("someone", "", "https://example.com/x?a=1&b=2"); err != ErrNotFound {
+				t.Errorf("LookupURL for another owner: err = %v, want ErrNotFound", err)
+			}
+
+			s.Delete("/a")
+			if l, err := idx.LookupURL("ci", "", "https://example.com/x?a=1&b=2"); err != nil || l.Path != "/b" {
+				t.Errorf("LookupURL after delete = %+v, %v, want /b", l, err)
+			}
+			s.Put(Link{Path: "/b", URL: "https://other.example", Owner: "ci"})
+			if _, err := idx.LookupURL("ci", "", "https://example.com/x?a=1&b=2"); err != ErrNotFound {
+				t.Errorf("LookupURL after update: err = %v, want ErrNotFound", err)
+			}
+
+			// Dead links are skipped.
+			past := time.Now().Add(-time.Minute)
+			s.Put(Link{Path: "/c", URL: "https://dead.example", Owner: "ci", ExpiresAt: &past})
+			s.Put(Link{Path: "/d", URL: "https://dead.example", Owner: "ci", MaxClicks: 1, Clicks: 1})
+			if _, err := idx.LookupURL("ci", "", "https://dead.example"); err != ErrNotFound {
+				t.Errorf("LookupURL of dead links: err = %v, want ErrNotFound", err)
+			}
+			s.Put(Link{Path: "/e", URL: "https://dead.example", Owner: "ci"})
+			if l, err := idx.LookupURL("ci", "", "https://dead.example"); err != nil || l.Path != "/e" {
+				t.Errorf("LookupURL past dead links = %+v, %v, want /e", l, err)
+			}
+		})
+	}
+}
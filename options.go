@@ -0,0 +1,234 @@
+package urlshort
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Option configures the handlers built by Handler, YAMLHandler
+// and JSONHandler.
+type Option func(*options)
+
+type options struct {
+	query     QueryPolicy
+	status    int
+	expired   http.Handler
+	exhausted http.Handler
+
+	secret      []byte        // signs password cookies
+	authTTL     time.Duration // lifetime of password cookies
+	maxAttempts int           // password attempts per link...
+	attemptsPer time.Duration // ...in this window
+	attempts    *attemptLimiter
+
+	recorder *Recorder
+
+	fallbacks map[string]http.Handler // by host pattern
+
+	norm    PathNorm
+	normSet bool          // norm was given, and applies to tables
+	targets *TargetPolicy // nil unless given
+	chains  *ChainPolicy  // nil unless given
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		query:  QueryDrop,
+		status: http.StatusFound,
+		expired: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "This link has expired.", http.StatusGone)
+		}),
+		exhausted: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "This link has been used up.", http.StatusGone)
+		}),
+		authTTL:     15 * time.Minute,
+		maxAttempts: 5,
+		attemptsPer: time.Minute,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.secret == nil {
+		o.secret = randomSecret()
+	}
+	o.attempts = newAttemptLimiter(o.maxAttempts, o.attemptsPer)
+	return o
+}
+
+// check validates the server-wide defaults.
+func (o options) check() error {
+	if err := o.query.check(); err != nil {
+		return fmt.Errorf("urlshort: default %v", err)
+	}
+	if err := checkStatus(o.status); err != nil {
+		return fmt.Errorf("urlshort: default %v", err)
+	}
+	if o.targets != nil {
+		if err := o.targets.check(); err != nil {
+			return err
+		}
+	}
+	if o.chains != nil {
+		if err := o.chains.check(); err != nil {
+			return err
+		}
+	}
+	for host := range o.fallbacks {
+		if host == "" {
+			return errors.New("urlshort: fallback for an empty host")
+		}
+		if err := checkHost(host); err != nil {
+			return fmt.Errorf("urlshort: fallback for %v", err)
+		}
+	}
+	return nil
+}
+
+// rules returns the configuration the links of a handler built
+// with o are compiled with.
+func (o options) rules() ruleConfig {
+	return ruleConfig{norm: o.norm, targets: o.targets, chains: o.chains}
+}
+
+// setRules applies the rule settings given in o to c.
+func (o options) setRules(c *ruleConfig) {
+	if o.normSet {
+		c.norm = o.norm
+	}
+	if o.targets != nil {
+		c.targets = o.targets
+	}
+	if o.chains != nil {
+		c.chains = o.chains
+	}
+}
+
+// fallback returns the handler for requests to host matching no
+// link.
+func (o options) fallback(host string, def http.Handler) http.Handler {
+	if h, ok := resolveHost(host, func(h string) bool { return o.fallbacks[h] != nil }); ok {
+		return o.fallbacks[h]
+	}
+	return def
+}
+
+// WithQueryPolicy sets the query policy used by rules that do
+// not set their own. The default is QueryDrop.
+func WithQueryPolicy(p QueryPolicy) Option {
+	return func(o *options) {
+		o.query = p
+	}
+}
+
+// WithStatus sets the status code used by rules that do not set
+// their own. It must be one of 301, 302, 303, 307 or 308; the
+// default is 302.
+func WithStatus(code int) Option {
+	return func(o *options) {
+		o.status = code
+	}
+}
+
+// WithExpiredHandler sets the handler serving requests for
+// expired links. The default responds 410 Gone.
+func WithExpiredHandler(h http.Handler) Option {
+	return func(o *options) {
+		o.expired = h
+	}
+}
+
+// WithExhaustedHandler sets the handler serving requests for
+// links that have used up their max_clicks. The default responds
+// 410 Gone.
+func WithExhaustedHandler(h http.Handler) Option {
+	return func(o *options) {
+		o.exhausted = h
+	}
+}
+
+// WithSecret sets the key signing the cookies that unlock
+// password-protected links. By default a random key is made for
+// each handler, so cookies do not survive a restart.
+func WithSecret(key []byte) Option {
+	return func(o *options) {
+		o.secret = key
+	}
+}
+
+// WithUnlockTTL sets how long a correct password unlocks a link
+// for. The default is 15 minutes.
+func WithUnlockTTL(d time.Duration) Option {
+	return func(o *options) {
+		o.authTTL = d
+	}
+}
+
+// WithPasswordAttempts limits password attempts to n per link in
+// every window. The default is 5 per minute.
+func WithPasswordAttempts(n int, window time.Duration) Option {
+	return func(o *options) {
+		o.maxAttempts, o.attemptsPer = n, window
+	}
+}
+
+// WithHostFallback has requests for host that match no link
+// served by h rather than by the handler's fallback. host is a
+// domain name, or "*." followed by one to cover its subdomains,
+// as in Link.Host.
+func WithHostFallback(host string, h http.Handler) Option {
+	return func(o *options) {
+		if o.fallbacks == nil {
+			o.fallbacks = make(map[string]http.Handler)
+		}
+		o.fallbacks[host] = h
+	}
+}
+
+// WithPathNorm sets the normalizations applied to the paths of
+// links and of requests. Given to TableHandler, it sets those of
+// the table, see Table.SetPathNorm. The default is none.
+func WithPathNorm(n PathNorm) Option {
+	return func(o *options) {
+		o.norm, o.normSet = n, true
+	}
+}
+
+// WithTargetPolicy restricts the URLs links may redirect to.
+// Given to TableHandler, it sets the policy of the table, see
+// Table.SetTargetPolicy. By default any http or https URL is
+// allowed.
+func WithTargetPolicy(p TargetPolicy) Option {
+	return func(o *options) {
+		o.targets = &p
+	}
+}
+
+// WithChainPolicy checks links that redirect to other links of
+// the server, see ChainPolicy. Given to TableHandler, it sets the
+// policy of the table, see Table.SetChainPolicy. By default such
+// links are not looked at.
+func WithChainPolicy(p ChainPolicy) Option {
+	return func(o *options) {
+		o.chains = &p
+	}
+}
+
+// WithRecorder records a Hit with rec for every redirect.
+func WithRecorder(rec *Recorder) Option {
+	return func(o *options) {
+		o.recorder = rec
+	}
+}
+
+// checkStatus reports an error unless code is a redirect status
+// the handler can send.
+func checkStatus(code int) error {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return nil
+	}
+	return fmt.Errorf("status %d is not a redirect status", code)
+}
@@ -0,0 +1,179 @@
+package urlshort
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	htmltemplate "html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HashPassword returns the bcrypt hash to store in
+// Link.PasswordHash for password.
+func HashPassword(password string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(h), nil
+}
+
+var passwordForm = htmltemplate.Must(htmltemplate.New("password").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Password required</title></head>
+<body>
+<h1>This link is password protected</h1>
+{{if .Error}}<p style="color: #b00">{{.Error}}</p>{{end}}
+<form method="post">
+<input type="password" name="password" autofocus required>
+<button type="submit">Continue</button>
+</form>
+</body>
+</html>
+`))
+
+// unlock serves the password form of a protected link. It
+// returns true once the visitor has proven they know the
+// password, either with a valid cookie or by posting the right
+// password, in which case the caller goes on to redirect.
+func (o options) unlock(w http.ResponseWriter, r *http.Request, l Link) bool {
+	key := l.Key()
+	name := authCookieName(key)
+	if c, err := r.Cookie(name); err == nil && o.validAuth(c.Value, l, time.Now()) {
+		return true
+	}
+	if r.Method != http.MethodPost {
+		showPasswordForm(w, http.StatusOK, "")
+		return false
+	}
+	if !o.attempts.allow(key, time.Now()) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(o.attempts.window/time.Second)))
+		showPasswordForm(w, http.StatusTooManyRequests, "Too many attempts, try again later.")
+		return false
+	}
+	pw := r.PostFormValue("password")
+	if bcrypt.CompareHashAndPassword([]byte(l.PasswordHash), []byte(pw)) != nil {
+		showPasswordForm(w, http.StatusUnauthorized, "Wrong password.")
+		return false
+	}
+	exp := time.Now().Add(o.authTTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    o.signAuth(l, exp),
+		Path:     "/",
+		Expires:  exp,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return true
+}
+
+func showPasswordForm(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	passwordForm.Execute(w, struct{ Error string }{msg})
+}
+
+// authCookieName returns the name of the cookie unlocking the
+// link stored under key.
+func authCookieName(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return "urlshort_" + hex.EncodeToString(h[:8])
+}
+
+// signAuth returns a cookie value unlocking l until exp. It is
+// the expiry time followed by an HMAC of the link's key, its
+// password hash and the expiry, so that changing the password
+// locks the link again.
+func (o options) signAuth(l Link, exp time.Time) string {
+	ts := strconv.FormatInt(exp.Unix(), 10)
+	return ts + "." + base64.RawURLEncoding.EncodeToString(o.authMAC(l, ts))
+}
+
+func (o options) validAuth(value string, l Link, now time.Time) bool {
+	i := strings.IndexByte(value, '.')
+	if i < 0 {
+		return false
+	}
+	ts, sig := value[:i], value[i+1:]
+	exp, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || now.Unix() >= exp {
+		return false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	return err == nil && hmac.Equal(mac, o.authMAC(l, ts))
+}
+
+func (o options) authMAC(l Link, ts string) []byte {
+	m := hmac.New(sha256.New, o.secret)
+	m.Write([]byte(l.Key()))
+	m.Write([]byte{0})
+	m.Write([]byte(l.PasswordHash))
+	m.Write([]byte{0})
+	m.Write([]byte(ts))
+	return m.Sum(nil)
+}
+
+// randomSecret returns a new key for signing cookies.
+func randomSecret() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// attemptLimiter allows a fixed number of password attempts per
+// link in each time window.
+type attemptLimiter struct {
+	max    int
+	window time.Duration
+
+	mu    sync.Mutex
+	links map[string]*attemptWindow
+}
+
+type attemptWindow struct {
+	start time.Time
+	n     int
+}
+
+func newAttemptLimiter(max int, window time.Duration) *attemptLimiter {
+	return &attemptLimiter{max: max, window: window, links: make(map[string]*attemptWindow)}
+}
+
+// allow records an attempt on path and reports whether it is
+// within the limit.
+func (l *attemptLimiter) allow(path string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	w := l.links[path]
+	if w == nil || now.Sub(w.start) >= l.window {
+		if len(l.links) > 10000 {
+			l.prune(now)
+		}
+		w = &attemptWindow{start: now}
+		l.links[path] = w
+	}
+	w.n++
+	return w.n <= l.max
+}
+
+// prune forgets windows that are over. l.mu must be held.
+func (l *attemptLimiter) prune(now time.Time) {
+	for path, w := range l.links {
+		if now.Sub(w.start) >= l.window {
+			delete(l.links, path)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package urlshort
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func postPassword(h http.Handler, target, password string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(url.Values{"password": {password}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPasswordProtectedLink(t *testing.T) {
+	hash, err := HashPassword("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := NewTable([]Link{{Path: "/docs", URL: "https://internal.example/docs", PasswordHash: hash}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := TableHandler(table, http.HandlerFunc(fallback), WithPasswordAttempts(3, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serve(h, "/docs")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `type="password"`) {
+		t.Fatalf("GET without cookie: %d %q, want the password form", rec.Code, rec.Body)
+	}
+	if rec := postPassword(h, "/docs", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password: status = %d, want 401", rec.Code)
+	}
+
+	rec = postPassword(h, "/docs", "s3cret")
+	assertRedirect(t, rec, http.StatusSeeOther, "https://internal.example/docs")
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies, want 1", len(cookies))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/docs", nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assertRedirect(t, rec, http.StatusFound, "https://internal.example/docs")
+
+	forged := *cookies[0]
+	forged.Value = strings.Replace(forged.Value, ".", "0.", 1)
+	req = httptest.NewRequest(http.MethodGet, "/docs", nil)
+	req.AddCookie(&forged)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("forged cookie: status = %d, want the form", rec.Code)
+	}
+
+	// With a third attempt the limit is used up; the fourth is
+	// refused even with the right password.
+	postPassword(h, "/docs", "wrong")
+	if rec := postPassword(h, "/docs", "s3cret"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("attempt over the limit: status = %d, want 429", rec.Code)
+	}
+
+	// Changing the password revokes the cookies issued before.
+	hash, err = HashPassword("n3w")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := table.Replace([]Link{{Path: "/docs", URL: "https://internal.example/docs", PasswordHash: hash}}); err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/docs", nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("cookie for the old password: status = %d, want the form", rec.Code)
+	}
+}
+
+func TestAPIPassword(t *testing.T) {
+	store := NewMemoryStore(nil)
+	api := NewAPI(store, nil)
+	rec := apiRequest(t, api, "POST", "/api/v1/links", `{"path": "/p", "url": "https://p.example", "password": "pw"}`)
+	assertCode(t, rec, http.StatusCreated)
+	if strings.Contains(rec.Body.String(), "password") {
+		t.Errorf("response leaks the password: %s", rec.Body)
+	}
+	if l, _ := store.Lookup("/p"); l.PasswordHash == "" {
+		t.Error("password hash not stored")
+	}
+
+	assertCode(t, apiRequest(t, api, "PATCH", "/api/v1/links/p", `{"password": ""}`), http.StatusOK)
+	if l, _ := store.Lookup("/p"); l.PasswordHash != "" {
+		t.Error("password not removed")
+	}
+}
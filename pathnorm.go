@@ -0,0 +1,180 @@
+package urlshort
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PathNorm is a set of normalizations applied to the paths of
+// links and of requests before they are matched, so that paths
+// differing only in ways users do not notice reach the same
+// link. Two links of a host whose paths are the same once
+// normalized collide, and are rejected when loaded.
+type PathNorm uint
+
+const (
+	// FoldCase matches paths regardless of ASCII letter case.
+	// Parameter values and prefix remainders keep the case of
+	// the request.
+	FoldCase PathNorm = 1 << iota
+	// TrimSlash ignores a trailing slash: /docs/ matches /docs.
+	// Prefix rules such as /gh/* keep theirs.
+	TrimSlash
+	// CollapseSlashes treats runs of slashes as one: //docs
+	// matches /docs.
+	CollapseSlashes
+	// DecodeUnreserved decodes percent-encoded letters, digits
+	// and "-", ".", "_" and "~" in the paths of links, as in
+	// /%7Ebob. Request paths always arrive decoded.
+	DecodeUnreserved
+
+	// NormalizeAll applies every normalization.
+	NormalizeAll = FoldCase | TrimSlash | CollapseSlashes | DecodeUnreserved
+)
+
+var pathNormNames = []struct {
+	name string
+	n    PathNorm
+}{
+	{"case", FoldCase},
+	{"trailing_slash", TrimSlash},
+	{"slashes", CollapseSlashes},
+	{"unreserved", DecodeUnreserved},
+}
+
+// ParsePathNorm parses a comma-separated list of normalizations:
+// "case", "trailing_slash", "slashes" and "unreserved", or "all".
+// An empty string or "none" is no normalization.
+func ParsePathNorm(s string) (PathNorm, error) {
+	var n PathNorm
+	if s == "" || s == "none" {
+		return 0, nil
+	}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "all" {
+			n |= NormalizeAll
+			continue
+		}
+		found := false
+		for _, nn := range pathNormNames {
+			if nn.name == name {
+				n |= nn.n
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("urlshort: unknown path normalization %q", name)
+		}
+	}
+	return n, nil
+}
+
+// String returns n in the format understood by ParsePathNorm.
+func (n PathNorm) String() string {
+	var names []string
+	for _, nn := range pathNormNames {
+		if n&nn.n != 0 {
+			names = append(names, nn.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// pattern normalizes the path of a link, without its wildcard.
+func (n PathNorm) pattern(path string, isPrefix bool) string {
+	if n&DecodeUnreserved != 0 {
+		path = decodeUnreserved(path)
+	}
+	path = n.path(path)
+	if !isPrefix {
+		path = n.trim(path)
+	}
+	return n.fold(path)
+}
+
+// path applies the normalizations that keep the case of path
+// and its trailing slash.
+func (n PathNorm) path(path string) string {
+	if n&CollapseSlashes != 0 && strings.Contains(path, "//") {
+		var b strings.Builder
+		for i := 0; i < len(path); i++ {
+			if path[i] == '/' && i > 0 && path[i-1] == '/' {
+				continue
+			}
+			b.WriteByte(path[i])
+		}
+		path = b.String()
+	}
+	return path
+}
+
+// trim removes the trailing slash of path, if n says so.
+func (n PathNorm) trim(path string) string {
+	if n&TrimSlash != 0 && len(path) > 1 && strings.HasSuffix(path, "/") {
+		return path[:len(path)-1]
+	}
+	return path
+}
+
+// fold lower-cases the ASCII letters of path, if n says so. The
+// result has the same length, so offsets into it are offsets
+// into path.
+func (n PathNorm) fold(path string) string {
+	if n&FoldCase == 0 {
+		return path
+	}
+	b := []byte(path)
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+// decodeUnreserved decodes the percent-encoded unreserved
+// characters of path, leaving other escapes alone.
+func decodeUnreserved(path string) string {
+	if !strings.Contains(path, "%") {
+		return path
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '%' && i+2 < len(path) {
+			if c, ok := unhex(path[i+1], path[i+2]); ok && isUnreserved(c) {
+				b.WriteByte(c)
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+func unhex(hi, lo byte) (byte, bool) {
+	h, ok1 := hexDigit(hi)
+	l, ok2 := hexDigit(lo)
+	return h<<4 | l, ok1 && ok2
+}
+
+func hexDigit(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
@@ -0,0 +1,129 @@
+package urlshort
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParsePathNorm(t *testing.T) {
+	for s, want := range map[string]PathNorm{
+		"":                     0,
+		"none":                 0,
+		"all":                  NormalizeAll,
+		"case":                 FoldCase,
+		"case, trailing_slash": FoldCase | TrimSlash,
+		"slashes,unreserved":   CollapseSlashes | DecodeUnreserved,
+	} {
+		n, err := ParsePathNorm(s)
+		if err != nil || n != want {
+			t.Errorf("ParsePathNorm(%q) = %v, %v, want %v", s, n, err, want)
+		}
+		if back, err := ParsePathNorm(n.String()); err != nil || back != n {
+			t.Errorf("ParsePathNorm(%q.String()) = %v, %v", s, back, err)
+		}
+	}
+	if _, err := ParsePathNorm("case,upper"); err == nil {
+		t.Error("unknown normalization: expected an error")
+	}
+}
+
+func TestPathNormPattern(t *testing.T) {
+	for _, tt := range []struct {
+		n        PathNorm
+		path     string
+		isPrefix bool
+		want     string
+	}{
+		{0, "/Docs//x/", false, "/Docs//x/"},
+		{FoldCase, "/Docs/:ID", false, "/docs/:id"},
+		{TrimSlash, "/docs/", false, "/docs"},
+		{TrimSlash, "/gh/", true, "/gh/"},
+		{TrimSlash, "/", false, "/"},
+		{CollapseSlashes, "//a///b", false, "/a/b"},
+		{DecodeUnreserved, "/%7Ebob/%41%2F%zz%4", false, "/~bob/A%2F%zz%4"},
+		{NormalizeAll, "/%44ocs//API/", false, "/docs/api"},
+	} {
+		if got := tt.n.pattern(tt.path, tt.isPrefix); got != tt.want {
+			t.Errorf("%v.pattern(%q, %v) = %q, want %q", tt.n, tt.path, tt.isPrefix, got, tt.want)
+		}
+	}
+}
+
+func TestPathNormHandler(t *testing.T) {
+	yml := `
+- path: /Docs
+  url: https://docs.example
+- path: /%7Ebob/
+  url: https://bob.example
+- path: /gh/*
+  url: https://github.com/{rest}
+- path: /Issue/:id
+  url: https://tracker.example/browse/{id}
+`
+	h, err := YAMLHandler([]byte(yml), http.HandlerFunc(fallback), WithPathNorm(NormalizeAll))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/docs", "/DOCS", "/docs/", "//docs", "/Docs"} {
+		assertRedirect(t, serve(h, path), http.StatusFound, "https://docs.example")
+	}
+	assertRedirect(t, serve(h, "/~BOB"), http.StatusFound, "https://bob.example")
+	assertRedirect(t, serve(h, "/GH/Gophercises/URLShort"), http.StatusFound, "https://github.com/Gophercises/URLShort")
+	assertRedirect(t, serve(h, "/gh//x"), http.StatusFound, "https://github.com/x")
+	assertRedirect(t, serve(h, "/issue/AbC/"), http.StatusFound, "https://tracker.example/browse/AbC")
+	assertFallback(t, serve(h, "/docsx"))
+
+	// Without normalization nothing changes.
+	h, err = YAMLHandler([]byte(yml), http.HandlerFunc(fallback))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRedirect(t, serve(h, "/Docs"), http.StatusFound, "https://docs.example")
+	assertFallback(t, serve(h, "/docs"))
+	assertFallback(t, serve(h, "/Docs/"))
+}
+
+func TestPathNormCollisions(t *testing.T) {
+	links := []Link{
+		{Path: "/docs", URL: "https://a.example"},
+		{Path: "/Docs/", URL: "https://b.example"},
+	}
+	if _, err := NewTable(links); err != nil {
+		t.Fatalf("without normalization: %v", err)
+	}
+	_, err := Handler(NewMemoryStore(links), nil, WithPathNorm(FoldCase|TrimSlash))
+	if err == nil || !strings.Contains(err.Error(), "collides with") {
+		t.Errorf("err = %v, want a collision", err)
+	}
+	if _, err := Handler(NewMemoryStore(links), nil, WithPathNorm(FoldCase)); err != nil {
+		t.Errorf("case folding alone: %v", err)
+	}
+
+	// A table refusing the normalization keeps serving as before.
+	table, err := NewTable(links)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TableHandler(table, nil, WithPathNorm(NormalizeAll)); err == nil {
+		t.Error("TableHandler: expected a collision")
+	}
+	if _, ok := table.lookup("", "/Docs/"); !ok {
+		t.Error("table changed by a failed SetPathNorm")
+	}
+
+	// The API refuses colliding links before storing them.
+	store := NewMemoryStore(links[:1])
+	table, err = LoadTable(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := table.SetPathNorm(NormalizeAll); err != nil {
+		t.Fatal(err)
+	}
+	api := NewAPI(store, table)
+	assertCode(t, apiRequest(t, api, "POST", "/api/v1/links", `{"path": "/DOCS", "url": "https://b.example"}`), http.StatusConflict)
+	if _, err := store.Lookup("/DOCS"); err != ErrNotFound {
+		t.Errorf("colliding link stored: err = %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package urlshort
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// QueryPolicy decides what happens to the query string of an
+// incoming request when it is redirected.
+type QueryPolicy string
+
+const (
+	// QueryDrop discards the request's query string.
+	QueryDrop QueryPolicy = "drop"
+	// QueryAppend appends the request's query string, as sent,
+	// after the target's own query.
+	QueryAppend QueryPolicy = "append"
+	// QueryMergeTarget merges both query strings; parameters
+	// present in the target keep the target's values.
+	QueryMergeTarget QueryPolicy = "merge_target"
+	// QueryMergeRequest merges both query strings; parameters
+	// present in the request replace the target's values.
+	QueryMergeRequest QueryPolicy = "merge_request"
+)
+
+// check reports an error unless p is one of the known policies.
+// The empty policy is valid and defers to the handler's default.
+func (p QueryPolicy) check() error {
+	switch p {
+	case "", QueryDrop, QueryAppend, QueryMergeTarget, QueryMergeRequest:
+		return nil
+	}
+	return fmt.Errorf("unknown query policy %q", string(p))
+}
+
+// applyQuery returns dest with the raw query of the incoming
+// request combined into it according to p. The fragment of dest,
+// if any, is kept at the end.
+func applyQuery(dest, query string, p QueryPolicy) string {
+	if query == "" || p == QueryDrop || p == "" {
+		return dest
+	}
+	base, frag := dest, ""
+	if i := strings.IndexByte(base, '#'); i >= 0 {
+		base, frag = base[:i], base[i:]
+	}
+	target := ""
+	if i := strings.IndexByte(base, '?'); i >= 0 {
+		base, target = base[:i], base[i+1:]
+	}
+
+	switch p {
+	case QueryAppend:
+		if target != "" {
+			query = target + "&" + query
+		}
+	case QueryMergeTarget, QueryMergeRequest:
+		tv, err1 := url.ParseQuery(target)
+		rv, err2 := url.ParseQuery(query)
+		if err1 != nil || err2 != nil {
+			// Malformed queries cannot be merged key by key;
+			// keep everything rather than lose parameters.
+			if target != "" {
+				query = target + "&" + query
+			}
+			break
+		}
+		winner, loser := tv, rv
+		if p == QueryMergeRequest {
+			winner, loser = rv, tv
+		}
+		for k, vs := range loser {
+			if _, ok := winner[k]; !ok {
+				winner[k] = vs
+			}
+		}
+		query = winner.Encode()
+	}
+	return base + "?" + query + frag
+}
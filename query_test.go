@@ -0,0 +1,53 @@
+package urlshort
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestApplyQuery(t *testing.T) {
+	tests := []struct {
+		dest, query string
+		policy      QueryPolicy
+		want        string
+	}{
+		{"https://a.example/x", "utm_source=mail", QueryDrop, "https://a.example/x"},
+		{"https://a.example/x", "utm_source=mail", "", "https://a.example/x"},
+		{"https://a.example/x", "", QueryAppend, "https://a.example/x"},
+		{"https://a.example/x", "utm_source=mail", QueryAppend, "https://a.example/x?utm_source=mail"},
+		{"https://a.example/x?a=1#top", "a=2&b=c%20d", QueryAppend, "https://a.example/x?a=1&a=2&b=c%20d#top"},
+		{"https://a.example/x?a=1&z=9#top", "a=2&b=3", QueryMergeTarget, "https://a.example/x?a=1&b=3&z=9#top"},
+		{"https://a.example/x?a=1&z=9", "a=2&b=3", QueryMergeRequest, "https://a.example/x?a=2&b=3&z=9"},
+		{"https://a.example/x", "q=go lang", QueryMergeRequest, "https://a.example/x?q=go+lang"},
+	}
+	for _, tt := range tests {
+		if got := applyQuery(tt.dest, tt.query, tt.policy); got != tt.want {
+			t.Errorf("applyQuery(%q, %q, %q) = %q, want %q", tt.dest, tt.query, tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestQueryPolicyPerRule(t *testing.T) {
+	yml := `
+- path: /keep
+  url: https://shop.example/?src=go
+  query: merge_target
+- path: /plain
+  url: https://shop.example/plain
+`
+	h, err := YAMLHandler([]byte(yml), http.HandlerFunc(fallback), WithQueryPolicy(QueryAppend))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRedirect(t, serve(h, "/keep?src=mail&utm_campaign=fall"), http.StatusFound,
+		"https://shop.example/?src=go&utm_campaign=fall")
+	assertRedirect(t, serve(h, "/plain?utm_campaign=fall"), http.StatusFound,
+		"https://shop.example/plain?utm_campaign=fall")
+
+	if _, err := YAMLHandler([]byte("- {path: /a, url: https://a.example, query: keep}"), http.HandlerFunc(fallback)); err == nil {
+		t.Error("unknown rule policy: expected an error")
+	}
+	if _, err := YAMLHandler([]byte(yml), http.HandlerFunc(fallback), WithQueryPolicy("keep")); err == nil {
+		t.Error("unknown default policy: expected an error")
+	}
+}
@@ -0,0 +1,379 @@
+package urlshort
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// wildcard marks a prefix rule when it ends a link's path:
+// "/gh/*" matches "/gh/" and every path below it.
+const wildcard = "*"
+
+// paramMarker starts a named parameter segment, as in
+// "/issue/:id".
+const paramMarker = ':'
+
+// restPlaceholder names the placeholder replaced in the target
+// of a prefix rule by the remainder matched by the wildcard.
+const restPlaceholder = "rest"
+
+// routes is a compiled, read-only set of links stored in radix
+// trees keyed by path, one per host, so a lookup costs one walk
+// down a tree no matter how many rules there are.
+type routes struct {
+	hosts    map[string]*node // by host pattern, "" for the default domain
+	links    []Link           // one per key, in the order first seen
+	norm     PathNorm         // applied to the patterns in the trees
+	warnings RuleErrors       // chains let through by ChainWarn
+}
+
+type node struct {
+	label    string // edge leading to this node
+	indices  string // first byte of each child's label
+	children []*node
+	param    *node // child matching a single parameter segment
+
+	exact  *rule // rule for the path ending at this node
+	prefix *rule // rule for every path starting here
+}
+
+// rule is a link compiled for matching.
+type rule struct {
+	link     Link
+	params   []string // parameter names in path order
+	isPrefix bool
+	target   *template
+	usesRest bool // target places the remainder itself
+}
+
+// match is the result of a successful lookup.
+type match struct {
+	*rule
+	values []string // parameter values, parallel to rule.params
+	rest   string   // path remainder matched by a wildcard
+}
+
+// compile builds the routes for links, checking them and
+// normalizing their paths with cfg. When two links share a key
+// the later one wins; patterns that differ only in the names of
+// their parameters, or only in what cfg.norm takes away, are
+// rejected. With cfg.chains, links leading to each other are
+// then checked as well. Errors are RuleErrors listing every
+// invalid link.
+func compile(links []Link, cfg ruleConfig) (*routes, error) {
+	norm := cfg.norm
+	rt := &routes{hosts: make(map[string]*node), norm: norm}
+	seen := make(map[string]int, len(links))
+	rules := make(map[string]*rule, len(links))
+	pos := make(map[string]int, len(links))
+	var errs RuleErrors
+	for i, l := range links {
+		r, err := newRule(l, cfg.targets)
+		if err != nil {
+			errs = append(errs, &RuleError{Key: l.Key(), Err: err, index: i})
+			continue
+		}
+		root := rt.hosts[l.Host]
+		if root == nil {
+			root = &node{}
+			rt.hosts[l.Host] = root
+		}
+		pattern, _ := splitWildcard(l.Path)
+		n := root.insertPattern(norm.pattern(pattern, r.isPrefix))
+		slot := &n.exact
+		if r.isPrefix {
+			slot = &n.prefix
+		}
+		if *slot != nil && (*slot).link.Path != l.Path {
+			err := fmt.Errorf("conflicts with %s", (*slot).link.Key())
+			if norm != 0 {
+				err = fmt.Errorf("collides with %s once paths are normalized (%v)", (*slot).link.Key(), norm)
+			}
+			errs = append(errs, &RuleError{Key: l.Key(), Err: err, index: i})
+			continue
+		}
+		*slot = r
+		rules[l.Key()], pos[l.Key()] = r, i
+		if i, ok := seen[l.Key()]; ok {
+			rt.links[i] = l
+		} else {
+			seen[l.Key()] = len(rt.links)
+			rt.links = append(rt.links, l)
+		}
+	}
+	if errs == nil && cfg.chains != nil {
+		errs = rt.checkChains(cfg.chains, rules, pos)
+	}
+	if errs != nil {
+		return nil, errs
+	}
+	return rt, nil
+}
+
+// newRule compiles l, whose URL must be allowed by targets.
+func newRule(l Link, targets *TargetPolicy) (*rule, error) {
+	if err := checkHost(l.Host); err != nil {
+		return nil, err
+	}
+	switch {
+	case l.Path == "":
+		return nil, errors.New("path is empty")
+	case l.Path[0] != '/':
+		return nil, fmt.Errorf("path %q does not start with /", l.Path)
+	case l.URL == "":
+		return nil, errors.New("url is empty")
+	}
+	key, isPrefix := splitWildcard(l.Path)
+	r := &rule{link: l, isPrefix: isPrefix}
+	bound := map[string]bool{}
+	if isPrefix {
+		bound[restPlaceholder] = true
+	}
+	for _, seg := range strings.Split(key, "/") {
+		if seg == "" || seg[0] != paramMarker {
+			continue
+		}
+		name := seg[1:]
+		if !validName(name) || name == restPlaceholder || bound[name] {
+			return nil, fmt.Errorf("invalid or duplicate parameter %q", seg)
+		}
+		bound[name] = true
+		r.params = append(r.params, name)
+	}
+	if err := l.Query.check(); err != nil {
+		return nil, err
+	}
+	if l.MaxClicks < 0 {
+		return nil, errors.New("max_clicks must not be negative")
+	}
+	if l.PasswordHash != "" {
+		if _, err := bcrypt.Cost([]byte(l.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("invalid password_hash: %v", err)
+		}
+	}
+	if l.Status != 0 {
+		if err := checkStatus(l.Status); err != nil {
+			return nil, err
+		}
+	}
+	t, err := parseTemplate(l.URL)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range t.names() {
+		if !bound[name] {
+			return nil, fmt.Errorf("placeholder {%s} is not bound by the path", name)
+		}
+		r.usesRest = r.usesRest || name == restPlaceholder
+	}
+	if name := t.hostPlaceholder(); name != "" {
+		return nil, fmt.Errorf("placeholder {%s} is not in the path, query or fragment of the url", name)
+	}
+	// Placeholders are checked with a value standing for any
+	// segment, so that the policy sees the URL's scheme and host,
+	// which they cannot change.
+	if err := targets.checkURL(t.expand(func(string) string { return "x" })); err != nil {
+		return nil, err
+	}
+	r.target = t
+	return r, nil
+}
+
+// splitWildcard reports whether path is a prefix rule and
+// returns it without the trailing wildcard.
+func splitWildcard(path string) (string, bool) {
+	if strings.HasSuffix(path, wildcard) {
+		return strings.TrimSuffix(path, wildcard), true
+	}
+	return path, false
+}
+
+// lookup finds the rule for path in the default domain.
+func (rt *routes) lookup(path string) (match, bool) {
+	return rt.lookupHost("", path)
+}
+
+// lookupHost finds the rule for path among the links of the
+// host pattern serving host, or of the default domain if there
+// is none. An exact rule always wins; otherwise the prefix rule
+// with the longest prefix is used. Static segments are tried
+// before parameters.
+func (rt *routes) lookupHost(host, path string) (match, bool) {
+	h, _ := resolveHost(host, func(h string) bool { return rt.hosts[h] != nil })
+	root := rt.hosts[h]
+	if root == nil {
+		return match{}, false
+	}
+	path = rt.norm.path(path)
+	m, ok := rt.search(root, path)
+	if (!ok || m.isPrefix) && rt.norm&TrimSlash != 0 {
+		// An exact rule for the path without its trailing slash
+		// beats a prefix rule for the path with it.
+		if trimmed := rt.norm.trim(path); trimmed != path {
+			if em, eok := rt.search(root, trimmed); eok && !em.isPrefix {
+				return em, true
+			}
+		}
+	}
+	return m, ok
+}
+
+// search walks the tree below root for path.
+func (rt *routes) search(root *node, path string) (match, bool) {
+	s := search{path: rt.norm.fold(path), orig: path, bestDepth: -1}
+	if m, ok := s.walk(root, 0, nil); ok {
+		return m, true
+	}
+	if s.best.rule != nil {
+		return s.best, true
+	}
+	return match{}, false
+}
+
+// search holds the state of a single lookup.
+type search struct {
+	path      string // the path matched against the tree
+	orig      string // the path values are taken from
+	best      match  // longest prefix rule seen so far
+	bestDepth int
+}
+
+func (s *search) walk(n *node, depth int, values []string) (match, bool) {
+	if n.prefix != nil && depth > s.bestDepth {
+		s.best = match{
+			rule:   n.prefix,
+			values: append([]string(nil), values...),
+			rest:   s.orig[depth:],
+		}
+		s.bestDepth = depth
+	}
+	if depth == len(s.path) {
+		if n.exact != nil {
+			return match{rule: n.exact, values: values}, true
+		}
+		return match{}, false
+	}
+	rest := s.path[depth:]
+	if c := n.child(rest[0]); c != nil && strings.HasPrefix(rest, c.label) {
+		if m, ok := s.walk(c, depth+len(c.label), values); ok {
+			return m, true
+		}
+	}
+	if n.param != nil {
+		end := strings.IndexByte(rest, '/')
+		if end < 0 {
+			end = len(rest)
+		}
+		if end > 0 {
+			return s.walk(n.param, depth+end, append(values, s.orig[depth:depth+end]))
+		}
+	}
+	return match{}, false
+}
+
+func (n *node) child(b byte) *node {
+	if i := strings.IndexByte(n.indices, b); i >= 0 {
+		return n.children[i]
+	}
+	return nil
+}
+
+// insertPattern returns the node for pattern below n, where
+// every segment starting with paramMarker is a parameter.
+func (n *node) insertPattern(pattern string) *node {
+	for {
+		i := strings.Index(pattern, "/"+string(paramMarker))
+		if i < 0 {
+			return n.insert(pattern)
+		}
+		n = n.insert(pattern[:i+1])
+		if n.param == nil {
+			n.param = &node{}
+		}
+		n = n.param
+		pattern = pattern[i+1:]
+		if j := strings.IndexByte(pattern, '/'); j >= 0 {
+			pattern = pattern[j:]
+		} else {
+			pattern = ""
+		}
+	}
+}
+
+// insert returns the node for the static key below n, creating
+// it and splitting existing edges as needed.
+func (n *node) insert(key string) *node {
+	for key != "" {
+		i := strings.IndexByte(n.indices, key[0])
+		if i < 0 {
+			c := &node{label: key}
+			n.indices += key[:1]
+			n.children = append(n.children, c)
+			return c
+		}
+		c := n.children[i]
+		l := commonPrefix(key, c.label)
+		if l < len(c.label) {
+			split := &node{
+				label:    c.label[:l],
+				indices:  c.label[l : l+1],
+				children: []*node{c},
+			}
+			c.label = c.label[l:]
+			n.children[i] = split
+			c = split
+		}
+		key = key[l:]
+		n = c
+	}
+	return n
+}
+
+func commonPrefix(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// param returns the value captured for the named parameter.
+func (m match) param(name string) string {
+	if name == restPlaceholder {
+		return m.rest
+	}
+	for i, p := range m.params {
+		if p == name {
+			return m.values[i]
+		}
+	}
+	return ""
+}
+
+// target returns the URL m redirects to. Placeholders in the
+// link's URL are expanded; a prefix rule without a {rest}
+// placeholder has the escaped remainder appended to its path,
+// after a slash, so that it can never extend the URL's host.
+func (m match) target() string {
+	dest := m.rule.target.expand(m.param)
+	if !m.isPrefix || m.usesRest {
+		return dest
+	}
+	rest := strings.TrimLeft(m.rest, "/")
+	if rest == "" {
+		return dest
+	}
+	rest = (&url.URL{Path: "/" + rest}).EscapedPath()
+	end := len(dest)
+	if i := strings.IndexAny(dest, "?#"); i >= 0 {
+		end = i
+	}
+	if strings.HasSuffix(dest[:end], "/") {
+		rest = rest[1:]
+	}
+	return dest[:end] + rest + dest[end:]
+}
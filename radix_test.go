@@ -0,0 +1,116 @@
+package urlshort
+
+import "testing"
+
+func mustCompile(t *testing.T, links []Link) *routes {
+	t.Helper()
+	rt, err := compile(links, ruleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rt
+}
+
+func TestRoutesLookup(t *testing.T) {
+	rt := mustCompile(t, []Link{
+		{Path: "/docs", URL: "https://docs.example"},
+		{Path: "/docs/*", URL: "https://docs.example/v1/"},
+		{Path: "/docs/api/*", URL: "https://api.example/{rest}?ref=go"},
+		{Path: "/gh/*", URL: "https://github.com/{rest}"},
+		{Path: "/g", URL: "https://google.com"},
+		{Path: "/search/*", URL: "https://search.example/?q=x#top"},
+		{Path: "/bare/*", URL: "https://bare.example"},
+		{Path: "/wiki*", URL: "https://wiki.example/page?lang=en"},
+	})
+	if len(rt.links) != 8 {
+		t.Errorf("len(links) = %d, want 8", len(rt.links))
+	}
+
+	tests := []struct {
+		path, want string
+	}{
+		{"/docs", "https://docs.example"},
+		{"/docs/", "https://docs.example/v1/"},
+		{"/docs/guide", "https://docs.example/v1/guide"},
+		{"/docs/api/users/1", "https://api.example/users/1?ref=go"},
+		{"/gh/gophercises/urlshort", "https://github.com/gophercises/urlshort"},
+		{"/gh/a b", "https://github.com/a%20b"},
+		{"/g", "https://google.com"},
+		{"/search/more", "https://search.example/more?q=x#top"},
+		// The remainder goes after a slash, never into the host.
+		{"/bare/foo", "https://bare.example/foo"},
+		{"/bare/@evil.example/x", "https://bare.example/@evil.example/x"},
+		{"/bare/", "https://bare.example"},
+		{"/wiki/Go", "https://wiki.example/page/Go?lang=en"},
+		{"/wiki//Go", "https://wiki.example/page/Go?lang=en"},
+	}
+	for _, tt := range tests {
+		m, ok := rt.lookup(tt.path)
+		if !ok {
+			t.Errorf("lookup(%q): no match", tt.path)
+			continue
+		}
+		if got := m.target(); got != tt.want {
+			t.Errorf("lookup(%q) target = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+
+	for _, path := range []string{"/", "/gh", "/go", "/doc", "/gx/a"} {
+		if m, ok := rt.lookup(path); ok {
+			t.Errorf("lookup(%q) = %+v, want no match", path, m.link)
+		}
+	}
+}
+
+func TestRoutesParams(t *testing.T) {
+	rt := mustCompile(t, []Link{
+		{Path: "/issue/:id", URL: "https://tracker.example/browse/PROJ-{id}"},
+		{Path: "/issue/new", URL: "https://tracker.example/create"},
+		{Path: "/u/:user/repo/:repo", URL: "https://git.example/{user}/{repo}"},
+		{Path: "/u/:user/*", URL: "https://git.example/{user}?path={rest}"},
+		{Path: "/q/:term", URL: "https://search.example/?q={term}"},
+		{Path: "/lit/:x", URL: "https://x.example/{{x}/{x}"},
+	})
+
+	tests := []struct {
+		path, want string
+	}{
+		{"/issue/42", "https://tracker.example/browse/PROJ-42"},
+		{"/issue/new", "https://tracker.example/create"},
+		{"/issue/a b", "https://tracker.example/browse/PROJ-a%20b"},
+		{"/u/ann/repo/site", "https://git.example/ann/site"},
+		{"/u/ann/repo/site/tree", "https://git.example/ann?path=repo%2Fsite%2Ftree"},
+		{"/q/go lang&more", "https://search.example/?q=go+lang%26more"},
+		{"/lit/y", "https://x.example/{x}/y"},
+	}
+	for _, tt := range tests {
+		m, ok := rt.lookup(tt.path)
+		if !ok {
+			t.Errorf("lookup(%q): no match", tt.path)
+			continue
+		}
+		if got := m.target(); got != tt.want {
+			t.Errorf("lookup(%q) target = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+
+	for _, path := range []string{"/issue/", "/issue/1/2", "/u/ann"} {
+		if m, ok := rt.lookup(path); ok {
+			t.Errorf("lookup(%q) = %+v, want no match", path, m.link)
+		}
+	}
+}
+
+func TestCompileRejectsUnboundPlaceholders(t *testing.T) {
+	for _, l := range []Link{
+		{Path: "/issue/:id", URL: "https://tracker.example/{key}"},
+		{Path: "/docs", URL: "https://docs.example/{rest}"},
+		{Path: "/a/:id/:id", URL: "https://a.example/{id}"},
+		{Path: "/a/:", URL: "https://a.example"},
+		{Path: "/a", URL: "https://a.example/{oops"},
+	} {
+		if _, err := compile([]Link{l}, ruleConfig{}); err == nil {
+			t.Errorf("compile(%+v): expected an error", l)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package urlshort
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Interval is the granularity of hit statistics.
+type Interval string
+
+// The intervals statistics are rolled up by. Times are in UTC.
+const (
+	Hourly Interval = "hour"
+	Daily  Interval = "day"
+)
+
+const (
+	// maxRollupKeys bounds the referrers and agents counted
+	// separately in a rollup; further ones are counted as
+	// "other".
+	maxRollupKeys = 100
+	// maxStatsBuckets bounds the intervals of a Stats query.
+	maxStatsBuckets = 1000
+	// topStats is the number of referrers and agents in Stats.
+	topStats = 10
+)
+
+func (iv Interval) check() error {
+	switch iv {
+	case Hourly, Daily:
+		return nil
+	}
+	return fmt.Errorf("urlshort: unknown interval %q", iv)
+}
+
+// truncate returns the start of the interval t falls in.
+func (iv Interval) truncate(t time.Time) time.Time {
+	t = t.UTC()
+	if iv == Daily {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return t.Truncate(time.Hour)
+}
+
+// next returns the start of the interval after the one starting
+// at t.
+func (iv Interval) next(t time.Time) time.Time {
+	if iv == Daily {
+		return t.AddDate(0, 0, 1)
+	}
+	return t.Add(time.Hour)
+}
+
+// Rollup counts the hits of a link during one interval.
+type Rollup struct {
+	Start     time.Time        `json:"start"`
+	Count     int64            `json:"count"`
+	Referrers map[string]int64 `json:"referrers,omitempty"` // by referring host
+	Agents    map[string]int64 `json:"agents,omitempty"`    // by user agent family
+	// Visitors counts distinct visitors. Only daily rollups
+	// have it.
+	Visitors *HLL `json:"visitors,omitempty"`
+}
+
+// StatsStore is implemented by stores that keep hit statistics.
+// They roll hits up as they are recorded, so that queries read
+// one rollup per interval rather than every hit.
+type StatsStore interface {
+	// Rollups returns the rollups of the link stored under
+	// path for the intervals of length iv starting in
+	// [from, to), ordered by start. Intervals without hits may
+	// be left out.
+	Rollups(path string, iv Interval, from, to time.Time) ([]Rollup, error)
+}
+
+// period identifies a rollup of a link.
+type period struct {
+	iv    Interval
+	start int64 // Unix seconds
+}
+
+// rollupHits sums hits into hourly and daily rollups, by link
+// path. Visitors are told apart by client address and user
+// agent; bots are not counted as visitors.
+func rollupHits(hits []Hit) map[string]map[period]*Rollup {
+	links := make(map[string]map[period]*Rollup)
+	for _, h := range hits {
+		rs := links[h.Path]
+		if rs == nil {
+			rs = make(map[period]*Rollup)
+			links[h.Path] = rs
+		}
+		for _, iv := range []Interval{Hourly, Daily} {
+			start := iv.truncate(h.Time)
+			p := period{iv, start.Unix()}
+			r := rs[p]
+			if r == nil {
+				r = &Rollup{Start: start}
+				rs[p] = r
+			}
+			r.Count++
+			addCount(&r.Referrers, referrerHost(h.Referrer), 1)
+			agent := agentFamily(h.UserAgent)
+			addCount(&r.Agents, agent, 1)
+			if iv == Daily && h.IPHash != "" && agent != "Bot" {
+				if r.Visitors == nil {
+					r.Visitors = &HLL{}
+				}
+				r.Visitors.Add(visitorHash(h))
+			}
+		}
+	}
+	return links
+}
+
+// merge adds the counts of o to r.
+func (r *Rollup) merge(o *Rollup) {
+	r.Count += o.Count
+	for k, n := range o.Referrers {
+		addCount(&r.Referrers, k, n)
+	}
+	for k, n := range o.Agents {
+		addCount(&r.Agents, k, n)
+	}
+	if o.Visitors != nil {
+		if r.Visitors == nil {
+			r.Visitors = &HLL{}
+		}
+		r.Visitors.Merge(o.Visitors)
+	}
+}
+
+// addCount adds n to the count of key in *m, or to "other" once
+// m holds maxRollupKeys keys.
+func addCount(m *map[string]int64, key string, n int64) {
+	if *m == nil {
+		*m = make(map[string]int64)
+	}
+	if _, ok := (*m)[key]; !ok && len(*m) >= maxRollupKeys {
+		key = "other"
+	}
+	(*m)[key] += n
+}
+
+// referrerHost returns the host a referrer URL points to.
+func referrerHost(ref string) string {
+	if ref == "" {
+		return "direct"
+	}
+	u, err := url.Parse(ref)
+	if err != nil || u.Host == "" {
+		return "other"
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
+
+// agentFamilies maps user agent substrings, in lower case, to
+// the family they identify. The first match wins, so more
+// specific tokens come first: Edge and Opera also claim to be
+// Chrome, and Chrome claims to be Safari.
+var agentFamilies = []struct{ token, family string }{
+	{"bot", "Bot"},
+	{"crawler", "Bot"},
+	{"spider", "Bot"},
+	{"edg/", "Edge"},
+	{"opr/", "Opera"},
+	{"chrome/", "Chrome"},
+	{"crios/", "Chrome"},
+	{"firefox/", "Firefox"},
+	{"fxios/", "Firefox"},
+	{"safari/", "Safari"},
+	{"curl/", "curl"},
+	{"wget/", "Wget"},
+	{"go-http-client/", "Go"},
+	{"python", "Python"},
+}
+
+// agentFamily returns the browser or client family of a user
+// agent string.
+func agentFamily(ua string) string {
+	if ua == "" {
+		return "unknown"
+	}
+	ua = strings.ToLower(ua)
+	for _, f := range agentFamilies {
+		if strings.Contains(ua, f.token) {
+			return f.family
+		}
+	}
+	return "other"
+}
+
+// Stats are the hits of a link over a time range.
+type Stats struct {
+	Path     string        `json:"path"`
+	From     time.Time     `json:"from"`
+	To       time.Time     `json:"to"`
+	Interval Interval      `json:"interval"`
+	Total    int64         `json:"total"`
+	Buckets  []StatsBucket `json:"buckets"`
+	// Referrers and Agents are the most frequent referring
+	// hosts and user agent families, most frequent first.
+	Referrers []StatsCount `json:"referrers"`
+	Agents    []StatsCount `json:"agents"`
+}
+
+// StatsBucket is the number of hits in the interval starting at
+// Start.
+type StatsBucket struct {
+	Start time.Time `json:"start"`
+	Count int64     `json:"count"`
+}
+
+// StatsCount is the number of hits with a given referrer or
+// agent.
+type StatsCount struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+// LinkStats returns the statistics of the link stored under path
+// between from and to, which are widened to whole intervals.
+// Every interval in the range has a bucket, with or without hits.
+func LinkStats(s StatsStore, path string, iv Interval, from, to time.Time) (Stats, error) {
+	st, err := emptyStats(path, iv, from, to)
+	if err != nil {
+		return Stats{}, err
+	}
+	rollups, err := s.Rollups(path, iv, st.From, st.To)
+	if err != nil {
+		return Stats{}, err
+	}
+	var sum Rollup
+	i := 0
+	for _, r := range rollups {
+		for i < len(st.Buckets) && st.Buckets[i].Start.Before(r.Start) {
+			i++
+		}
+		if i < len(st.Buckets) && st.Buckets[i].Start.Equal(r.Start) {
+			st.Buckets[i].Count = r.Count
+		}
+		sum.merge(&r)
+	}
+	st.Total = sum.Count
+	st.Referrers = topCounts(sum.Referrers)
+	st.Agents = topCounts(sum.Agents)
+	return st, nil
+}
+
+// Visitors is the approximate number of distinct visitors of a
+// link over a range of days.
+type Visitors struct {
+	Path     string        `json:"path"`
+	From     time.Time     `json:"from"`
+	To       time.Time     `json:"to"`
+	Visitors uint64        `json:"visitors"`
+	Days     []VisitorsDay `json:"days"`
+}
+
+// VisitorsDay is the approximate number of distinct visitors on
+// the day starting at Start.
+type VisitorsDay struct {
+	Start    time.Time `json:"start"`
+	Visitors uint64    `json:"visitors"`
+}
+
+// LinkVisitors estimates the distinct visitors of the link
+// stored under path between from and to, which are widened to
+// whole days. The total merges the daily sketches, so a visitor
+// coming back on several days is counted once.
+func LinkVisitors(s StatsStore, path string, from, to time.Time) (Visitors, error) {
+	st, err := emptyStats(path, Daily, from, to)
+	if err != nil {
+		return Visitors{}, err
+	}
+	rollups, err := s.Rollups(path, Daily, st.From, st.To)
+	if err != nil {
+		return Visitors{}, err
+	}
+	v := Visitors{Path: path, From: st.From, To: st.To, Days: make([]VisitorsDay, len(st.Buckets))}
+	for i, b := range st.Buckets {
+		v.Days[i].Start = b.Start
+	}
+	var all HLL
+	i := 0
+	for _, r := range rollups {
+		for i < len(v.Days) && v.Days[i].Start.Before(r.Start) {
+			i++
+		}
+		if i < len(v.Days) && v.Days[i].Start.Equal(r.Start) {
+			v.Days[i].Visitors = r.Visitors.Estimate()
+		}
+		all.Merge(r.Visitors)
+	}
+	v.Visitors = all.Estimate()
+	return v, nil
+}
+
+// emptyStats returns the Stats of a link without hits, checking
+// the interval and the range.
+func emptyStats(path string, iv Interval, from, to time.Time) (Stats, error) {
+	if err := iv.check(); err != nil {
+		return Stats{}, err
+	}
+	from = iv.truncate(from)
+	if end := iv.truncate(to); end.Before(to) {
+		to = iv.next(end)
+	} else {
+		to = end
+	}
+	if !from.Before(to) {
+		return Stats{}, fmt.Errorf("urlshort: %s: empty time range", path)
+	}
+	st := Stats{Path: path, From: from, To: to, Interval: iv, Buckets: []StatsBucket{}}
+	for t := from; t.Before(to); t = iv.next(t) {
+		if len(st.Buckets) == maxStatsBuckets {
+			return Stats{}, fmt.Errorf("urlshort: %s: time range spans more than %d intervals", path, maxStatsBuckets)
+		}
+		st.Buckets = append(st.Buckets, StatsBucket{Start: t})
+	}
+	return st, nil
+}
+
+// topCounts returns the topStats largest counts in m.
+func topCounts(m map[string]int64) []StatsCount {
+	counts := make([]StatsCount, 0, len(m))
+	for k, n := range m {
+		counts = append(counts, StatsCount{k, n})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Name < counts[j].Name
+	})
+	if len(counts) > topStats {
+		counts = counts[:topStats]
+	}
+	return counts
+}
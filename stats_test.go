@@ -0,0 +1,172 @@
+package urlshort
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLinkStats(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	hits := []Hit{
+		{Time: day.Add(1 * time.Hour), Path: "/a", Referrer: "https://www.news.example/item?id=1", UserAgent: "Mozilla/5.0 (X11) Gecko/20100101 Firefox/123.0"},
+		{Time: day.Add(1*time.Hour + 30*time.Minute), Path: "/a", UserAgent: "curl/8.4.0"},
+		{Time: day.Add(26 * time.Hour), Path: "/a", Referrer: "https://news.example/", UserAgent: "Mozilla/5.0 AppleWebKit/537.36 Chrome/122.0 Safari/537.36 Edg/122.0"},
+		{Time: day.Add(2 * time.Hour), Path: "/b"},
+	}
+	for name, open := range storeFactories {
+		t.Run(name, func(t *testing.T) {
+			s := open(t, t.TempDir())
+			hs, ok := s.(HitStore)
+			if !ok {
+				t.Skipf("%T keeps no statistics", s)
+			}
+			// Record in two batches, so rollups are merged.
+			if err := hs.RecordHits(hits[:2]); err != nil {
+				t.Fatal(err)
+			}
+			if err := hs.RecordHits(hits[2:]); err != nil {
+				t.Fatal(err)
+			}
+			ss := s.(StatsStore)
+
+			st, err := LinkStats(ss, "/a", Daily, day, day.Add(48*time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st.Total != 3 || len(st.Buckets) != 2 || st.Buckets[0].Count != 2 || st.Buckets[1].Count != 1 {
+				t.Errorf("daily stats = %+v", st)
+			}
+			if len(st.Referrers) != 2 || st.Referrers[0] != (StatsCount{"news.example", 2}) {
+				t.Errorf("referrers = %+v", st.Referrers)
+			}
+			if len(st.Agents) != 3 || st.Agents[0] != (StatsCount{"Edge", 1}) {
+				t.Errorf("agents = %+v", st.Agents)
+			}
+
+			st, err = LinkStats(ss, "/a", Hourly, day.Add(90*time.Minute), day.Add(150*time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !st.From.Equal(day.Add(time.Hour)) || len(st.Buckets) != 2 || st.Buckets[0].Count != 2 || st.Total != 2 {
+				t.Errorf("hourly stats = %+v", st)
+			}
+
+			if _, err := LinkStats(ss, "/a", Hourly, day, day.AddDate(1, 0, 0)); err == nil {
+				t.Error("a year by hour was accepted")
+			}
+		})
+	}
+}
+
+func TestStatsAPI(t *testing.T) {
+	store := NewMemoryStore([]Link{{Path: "/a", URL: "https://a.example"}})
+	api := NewAPI(store, nil)
+	now := time.Now().UTC()
+	store.RecordHits([]Hit{{Time: now, Path: "/a"}, {Time: now, Path: "/a"}})
+
+	rec := apiRequest(t, api, "GET", "/api/v1/links/a/stats?interval=hour", "")
+	assertCode(t, rec, http.StatusOK)
+	var st Stats
+	if err := json.NewDecoder(rec.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Total != 2 || len(st.Buckets) != 25 || st.Buckets[24].Count != 2 {
+		t.Errorf("stats = %+v", st)
+	}
+
+	rec = apiRequest(t, api, "GET", "/api/v1/links/a/stats?from=2024-03-01&to=2024-03-08", "")
+	assertCode(t, rec, http.StatusOK)
+	if err := json.NewDecoder(rec.Body).Decode(&st); err != nil || len(st.Buckets) != 7 || st.Total != 0 {
+		t.Errorf("stats = %+v, %v", st, err)
+	}
+
+	assertCode(t, apiRequest(t, api, "GET", "/api/v1/links/a/stats?interval=week", ""), http.StatusBadRequest)
+	assertCode(t, apiRequest(t, api, "GET", "/api/v1/links/a/stats?from=yesterday", ""), http.StatusBadRequest)
+	assertCode(t, apiRequest(t, api, "GET", "/api/v1/links/a/stats?from=2024-03-08&to=2024-03-01", ""), http.StatusBadRequest)
+	assertCode(t, apiRequest(t, api, "GET", "/api/v1/links/b/stats", ""), http.StatusNotFound)
+	assertCode(t, apiRequest(t, api, "POST", "/api/v1/links/a/stats", ""), http.StatusMethodNotAllowed)
+
+	// File stores keep no statistics.
+	fs, err := OpenFileStore(filepath.Join(t.TempDir(), "links.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Put(Link{Path: "/a", URL: "https://a.example"}); err != nil {
+		t.Fatal(err)
+	}
+	api = NewAPI(fs, nil)
+	assertCode(t, apiRequest(t, api, "GET", "/api/v1/links/a/stats", ""), http.StatusNotImplemented)
+	assertCode(t, apiRequest(t, api, "GET", "/api/v1/links/a/visitors", ""), http.StatusNotImplemented)
+}
+
+func TestMemoryStatsRetention(t *testing.T) {
+	store := NewMemoryStore([]Link{{Path: "/a", URL: "https://a.example"}})
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	store.RecordHits([]Hit{{Time: day, Path: "/a"}, {Time: day, Path: "/b"}})
+	store.RecordHits([]Hit{{Time: day.AddDate(0, 0, 40), Path: "/a"}})
+
+	st, err := LinkStats(store, "/a", Daily, day, day.AddDate(0, 0, 41))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Total != 1 {
+		t.Errorf("total = %d, want 1, the old rollups pruned", st.Total)
+	}
+	if err := store.Delete("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.stats) != 1 {
+		t.Errorf("rollups kept for %d links, want 1", len(store.stats))
+	}
+}
+
+func TestLinkVisitors(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	ua := "Mozilla/5.0 Firefox/123.0"
+	hits := []Hit{
+		// The same visitor reloading, on two days.
+		{Time: day, Path: "/a", IPHash: "1", UserAgent: ua},
+		{Time: day.Add(time.Minute), Path: "/a", IPHash: "1", UserAgent: ua},
+		{Time: day.Add(25 * time.Hour), Path: "/a", IPHash: "1", UserAgent: ua},
+		// Another browser behind the same address.
+		{Time: day, Path: "/a", IPHash: "1", UserAgent: "curl/8.4.0"},
+		{Time: day.Add(25 * time.Hour), Path: "/a", IPHash: "2", UserAgent: ua},
+		{Time: day, Path: "/a", IPHash: "3", UserAgent: "Googlebot/2.1"},
+	}
+	for name, open := range storeFactories {
+		t.Run(name, func(t *testing.T) {
+			s := open(t, t.TempDir())
+			hs, ok := s.(HitStore)
+			if !ok {
+				t.Skipf("%T keeps no statistics", s)
+			}
+			if err := hs.RecordHits(hits); err != nil {
+				t.Fatal(err)
+			}
+			v, err := LinkVisitors(s.(StatsStore), "/a", day, day.Add(72*time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.Visitors != 3 || len(v.Days) != 3 || v.Days[0].Visitors != 2 || v.Days[1].Visitors != 2 || v.Days[2].Visitors != 0 {
+				t.Errorf("visitors = %+v", v)
+			}
+		})
+	}
+}
+
+func TestVisitorsAPI(t *testing.T) {
+	store := NewMemoryStore([]Link{{Path: "/a", URL: "https://a.example"}})
+	api := NewAPI(store, nil)
+	store.RecordHits([]Hit{{Time: time.Now(), Path: "/a", IPHash: "1"}})
+
+	rec := apiRequest(t, api, "GET", "/api/v1/links/a/visitors", "")
+	assertCode(t, rec, http.StatusOK)
+	var v Visitors
+	if err := json.NewDecoder(rec.Body).Decode(&v); err != nil || v.Visitors != 1 || len(v.Days) != 31 {
+		t.Errorf("visitors = %+v, %v", v, err)
+	}
+	assertCode(t, apiRequest(t, api, "GET", "/api/v1/links/a/nope", ""), http.StatusNotFound)
+}
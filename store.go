@@ -0,0 +1,376 @@
+package urlshort
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned by a Store when no link is stored
+// under the requested path.
+var ErrNotFound = errors.New("urlshort: link not found")
+
+// ErrExhausted is returned by ClickCounter.Consume when a link
+// has used up all its clicks.
+var ErrExhausted = errors.New("urlshort: link exhausted")
+
+// Link is a single redirect rule: requests for Path are sent
+// to URL.
+type Link struct {
+	Path string `yaml:"path" json:"path"`
+	URL  string `yaml:"url" json:"url"`
+
+	// Host is the domain the link belongs to, or, starting with
+	// "*.", the subdomains of a domain. Links without a host
+	// belong to the default domain, which serves the requests
+	// for every host without links of its own.
+	Host string `yaml:"host,omitempty" json:"host,omitempty"`
+
+	// Query is the QueryPolicy for this link; empty means the
+	// handler's default.
+	Query QueryPolicy `yaml:"query,omitempty" json:"query,omitempty"`
+	// Status is the redirect status code for this link; zero
+	// means the handler's default.
+	Status int `yaml:"status,omitempty" json:"status,omitempty"`
+	// Owner identifies who created the link. Links are only
+	// deduplicated against links of the same owner.
+	Owner string `yaml:"owner,omitempty" json:"owner,omitempty"`
+	// ExpiresAt is when the link stops redirecting; nil means
+	// never.
+	ExpiresAt *time.Time `yaml:"expires_at,omitempty" json:"expires_at,omitempty"`
+	// TTL is an alternative to ExpiresAt in a duration format
+	// understood by time.ParseDuration, such as "72h". It is
+	// counted from when the link is loaded or created, and is
+	// turned into ExpiresAt at that point; a FileStore writes
+	// that back to its file.
+	TTL string `yaml:"ttl,omitempty" json:"ttl,omitempty"`
+	// MaxClicks is the number of times the link redirects before
+	// it is exhausted; zero means no limit. Clicks counts the
+	// redirects done so far.
+	MaxClicks int `yaml:"max_clicks,omitempty" json:"max_clicks,omitempty"`
+	Clicks    int `yaml:"clicks,omitempty" json:"clicks,omitempty"`
+	// PasswordHash, if set, is the bcrypt hash of the password
+	// visitors must enter before being redirected. See
+	// HashPassword.
+	PasswordHash string `yaml:"password_hash,omitempty" json:"password_hash,omitempty"`
+}
+
+// Key returns the key l is stored under: its path, preceded by
+// its host if it has one, as in "go.corp/docs".
+func (l Link) Key() string {
+	return l.Host + l.Path
+}
+
+// splitKey returns the host and the path of a key returned by
+// Link.Key.
+func splitKey(key string) (host, path string) {
+	i := strings.IndexByte(key, '/')
+	if i < 0 {
+		return key, ""
+	}
+	return key[:i], key[i:]
+}
+
+// Expired reports whether l has expired at t.
+func (l Link) Expired(t time.Time) bool {
+	return l.ExpiresAt != nil && !t.Before(*l.ExpiresAt)
+}
+
+// exhausted reports whether l has used up its clicks.
+func (l Link) exhausted() bool {
+	return l.MaxClicks > 0 && l.Clicks >= l.MaxClicks
+}
+
+// resolveTTL turns the TTL of l, if set, into an expiry time
+// counted from now.
+func resolveTTL(l *Link, now time.Time) error {
+	if l.TTL == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(l.TTL)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid ttl %q", l.TTL)
+	}
+	at := now.Add(d)
+	if l.ExpiresAt == nil || at.Before(*l.ExpiresAt) {
+		l.ExpiresAt = &at
+	}
+	l.TTL = ""
+	return nil
+}
+
+// Store is the storage layer behind Handler. Links are stored
+// under their key, which is their path unless they belong to a
+// host; see Link.Key. Implementations must be safe for
+// concurrent use.
+type Store interface {
+	// Lookup returns the link stored under key, or ErrNotFound
+	// if there is none.
+	Lookup(key string) (Link, error)
+	// Put creates or replaces the link stored under
+	// link.Key().
+	Put(link Link) error
+	// Delete removes the link stored under key. Deleting a key
+	// that does not exist returns ErrNotFound.
+	Delete(key string) error
+	// List returns every stored link ordered by host, then
+	// path, the links of the default domain first.
+	List() ([]Link, error)
+}
+
+// ClickCounter is implemented by stores that can enforce the
+// MaxClicks limit of links.
+type ClickCounter interface {
+	// Consume atomically uses up one click of the link stored
+	// under key and returns the updated link. When the link has
+	// no clicks left it returns ErrExhausted and changes nothing,
+	// so concurrent requests can never share the last click.
+	Consume(key string) (Link, error)
+}
+
+// Updater is implemented by stores that can change a stored
+// link in place.
+type Updater interface {
+	// Update calls change with the link stored under key and
+	// stores the result, atomically, so changes made meanwhile,
+	// such as clicks consumed, are not lost. change must not
+	// alter the key. If it returns an error, nothing is stored.
+	Update(key string, change func(*Link) error) (Link, error)
+}
+
+// consume is the check shared by ClickCounter implementations.
+func consume(l *Link) error {
+	if l.exhausted() {
+		return ErrExhausted
+	}
+	l.Clicks++
+	return nil
+}
+
+// memoryStatsAge is how far back from the latest hit of a link
+// a MemoryStore keeps its rollups.
+const memoryStatsAge = 31 * 24 * time.Hour
+
+// MemoryStore is a Store that keeps its links in a map. It
+// implements URLIndex, ClickCounter, Updater, HitStore and
+// StatsStore. Hits are only rolled up, and the rollups kept for
+// the 31 days up to the latest hit of each link. Nothing is
+// kept across restarts; use a BoltStore for that. The zero
+// value is not usable; create one with NewMemoryStore.
+type MemoryStore struct {
+	mu    sync.RWMutex
+	links map[string]Link            // by key
+	urls  map[string]map[string]bool // urlKey -> set of keys
+	stats map[string]map[period]*Rollup // link key -> rollups
+}
+
+// NewMemoryStore returns a MemoryStore holding links.
+func NewMemoryStore(links []Link) *MemoryStore {
+	s := &MemoryStore{}
+	s.replace(links)
+	return s
+}
+
+// Lookup implements Store.
+func (s *MemoryStore) Lookup(key string) (Link, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	l, ok := s.links[key]
+	if !ok {
+		return Link{}, ErrNotFound
+	}
+	return l, nil
+}
+
+// Put implements Store.
+func (s *MemoryStore) Put(link Link) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unindex(link.Key())
+	s.links[link.Key()] = link
+	s.index(link)
+	return nil
+}
+
+// Delete implements Store.
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.links[key]; !ok {
+		return ErrNotFound
+	}
+	s.unindex(key)
+	delete(s.links, key)
+	delete(s.stats, key)
+	return nil
+}
+
+// List implements Store.
+func (s *MemoryStore) List() ([]Link, error) {
+	s.mu.RLock()
+	links := make([]Link, 0, len(s.links))
+	for _, l := range s.links {
+		links = append(links, l)
+	}
+	s.mu.RUnlock()
+	sortLinks(links)
+	return links, nil
+}
+
+// Consume implements ClickCounter.
+func (s *MemoryStore) Consume(key string) (Link, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.links[key]
+	if !ok {
+		return Link{}, ErrNotFound
+	}
+	if err := consume(&l); err != nil {
+		return l, err
+	}
+	s.links[key] = l
+	return l, nil
+}
+
+// Update implements Updater.
+func (s *MemoryStore) Update(key string, change func(*Link) error) (Link, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.links[key]
+	if !ok {
+		return Link{}, ErrNotFound
+	}
+	if err := change(&l); err != nil {
+		return Link{}, err
+	}
+	s.unindex(key)
+	s.links[key] = l
+	s.index(l)
+	return l, nil
+}
+
+// RecordHits implements HitStore.
+func (s *MemoryStore) RecordHits(hits []Hit) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stats == nil {
+		s.stats = make(map[string]map[period]*Rollup)
+	}
+	for key, rs := range rollupHits(hits) {
+		stored := s.stats[key]
+		if stored == nil {
+			stored = make(map[period]*Rollup)
+			s.stats[key] = stored
+		}
+		var latest int64
+		for p, r := range rs {
+			if old := stored[p]; old != nil {
+				old.merge(r)
+			} else {
+				stored[p] = r
+			}
+			if p.start > latest {
+				latest = p.start
+			}
+		}
+		limit := latest - int64(memoryStatsAge/time.Second)
+		for p := range stored {
+			if p.start < limit {
+				delete(stored, p)
+			}
+		}
+	}
+	return nil
+}
+
+// Rollups implements StatsStore.
+func (s *MemoryStore) Rollups(key string, iv Interval, from, to time.Time) ([]Rollup, error) {
+	s.mu.RLock()
+	var rollups []Rollup
+	for p, r := range s.stats[key] {
+		if p.iv == iv && !r.Start.Before(from) && r.Start.Before(to) {
+			c := Rollup{Start: r.Start}
+			c.merge(r)
+			rollups = append(rollups, c)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(rollups, func(i, j int) bool { return rollups[i].Start.Before(rollups[j].Start) })
+	return rollups, nil
+}
+
+// LookupURL implements URLIndex. When several links qualify,
+// the one with the smallest key is returned.
+func (s *MemoryStore) LookupURL(owner, host, rawurl string) (Link, error) {
+	key, ok := urlKey(Link{Path: "/", URL: rawurl, Owner: owner, Host: host})
+	if !ok {
+		return Link{}, ErrNotFound
+	}
+	now := time.Now()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	best := ""
+	for k := range s.urls[key] {
+		if l := s.links[k]; (best == "" || k < best) && !l.Expired(now) && !l.exhausted() {
+			best = k
+		}
+	}
+	if best == "" {
+		return Link{}, ErrNotFound
+	}
+	return s.links[best], nil
+}
+
+// replace swaps the whole content of the store for links.
+func (s *MemoryStore) replace(links []Link) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.links = make(map[string]Link, len(links))
+	s.urls = make(map[string]map[string]bool)
+	for _, l := range links {
+		s.unindex(l.Key())
+		s.links[l.Key()] = l
+		s.index(l)
+	}
+}
+
+// index adds l to the reverse index. s.mu must be held.
+func (s *MemoryStore) index(l Link) {
+	key, ok := urlKey(l)
+	if !ok {
+		return
+	}
+	if s.urls[key] == nil {
+		s.urls[key] = make(map[string]bool)
+	}
+	s.urls[key][l.Key()] = true
+}
+
+// unindex removes the link stored under key from the reverse
+// index. s.mu must be held.
+func (s *MemoryStore) unindex(key string) {
+	l, ok := s.links[key]
+	if !ok {
+		return
+	}
+	uk, ok := urlKey(l)
+	if !ok {
+		return
+	}
+	delete(s.urls[uk], key)
+	if len(s.urls[uk]) == 0 {
+		delete(s.urls, uk)
+	}
+}
+
+func sortLinks(links []Link) {
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].Host != links[j].Host {
+			return links[i].Host < links[j].Host
+		}
+		return links[i].Path < links[j].Path
+	})
+}
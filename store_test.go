@@ -0,0 +1,206 @@
+package urlshort
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// storeFactories builds every Store implementation in a fresh
+// temporary directory.
+var storeFactories = map[string]func(t *testing.T, dir string) Store{
+	"memory": func(t *testing.T, dir string) Store {
+		return NewMemoryStore(nil)
+	},
+	"yaml": func(t *testing.T, dir string) Store {
+		s, err := OpenFileStore(filepath.Join(dir, "links.yaml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	},
+	"json": func(t *testing.T, dir string) Store {
+		s, err := OpenFileStore(filepath.Join(dir, "links.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	},
+	"bolt": func(t *testing.T, dir string) Store {
+		s, err := OpenBoltStore(filepath.Join(dir, "links.db"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	},
+}
+
+func TestStores(t *testing.T) {
+	for name, open := range storeFactories {
+		t.Run(name, func(t *testing.T) {
+			s := open(t, t.TempDir())
+
+			if _, err := s.Lookup("/a"); err != ErrNotFound {
+				t.Fatalf("Lookup on empty store: err = %v, want ErrNotFound", err)
+			}
+			for _, l := range []Link{
+				{Path: "/b", URL: "https://b.example"},
+				{Path: "/a", URL: "https://a.example"},
+			} {
+				if err := s.Put(l); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := s.Lookup("/a")
+			if err != nil || got.URL != "https://a.example" {
+				t.Errorf("Lookup(/a) = %+v, %v", got, err)
+			}
+			links, err := s.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []Link{{Path: "/a", URL: "https://a.example"}, {Path: "/b", URL: "https://b.example"}}
+			if !reflect.DeepEqual(links, want) {
+				t.Errorf("List() = %+v, want %+v", links, want)
+			}
+			if err := s.Delete("/a"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete("/a"); err != ErrNotFound {
+				t.Errorf("second Delete: err = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestFileStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "links.yaml")
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(Link{Path: "/a", URL: "https://a.example"}); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, err := reopened.Lookup("/a"); err != nil || l.URL != "https://a.example" {
+		t.Errorf("Lookup after reopen = %+v, %v", l, err)
+	}
+}
+
+func TestFileStoreTTL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "links.yaml")
+	if err := ioutil.WriteFile(path, []byte("- {path: /a, url: https://a.example, ttl: 1h}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := s.Lookup("/a")
+	if err != nil || l.ExpiresAt == nil {
+		t.Fatalf("Lookup() = %+v, %v", l, err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "ttl") || !strings.Contains(string(data), "expires_at") {
+		t.Errorf("ttl not written back:\n%s", data)
+	}
+
+	// Neither reloads nor restarts push the expiry back.
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*FileStore{s, reopened} {
+		if got, err := s.Lookup("/a"); err != nil || got.ExpiresAt == nil || !got.ExpiresAt.Equal(*l.ExpiresAt) {
+			t.Errorf("expiry moved from %v: %+v, %v", l.ExpiresAt, got, err)
+		}
+	}
+
+	// A ttl added by hand on a reload is resolved the same way.
+	if err := ioutil.WriteFile(path, []byte("- {path: /b, url: https://b.example, ttl: 1h}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(path); strings.Contains(string(data), "ttl") {
+		t.Errorf("ttl not written back on reload:\n%s", data)
+	}
+}
+
+func TestBoltStoreHitRetention(t *testing.T) {
+	s := storeFactories["bolt"](t, t.TempDir()).(*BoltStore)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	hits := []Hit{
+		{Time: now.Add(-40 * 24 * time.Hour), Path: "/a"},
+		{Time: now.Add(-20 * 24 * time.Hour), Path: "/a"},
+		{Time: now.Add(-40 * 24 * time.Hour), Path: "/b"},
+	}
+	if err := s.RecordHits(hits); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RecordHits([]Hit{{Time: now, Path: "/a"}}); err != nil {
+		t.Fatal(err)
+	}
+	count := map[string]int{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(hitsBucket).ForEach(func(k, _ []byte) error {
+			count[string(k[:bytes.IndexByte(k, 0)])]++
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// /b had no hit since, so it is left alone.
+	if count["/a"] != 2 || count["/b"] != 1 {
+		t.Errorf("hits kept = %v, want /a:2 /b:1", count)
+	}
+	// Rollups keep counting the pruned hits.
+	rs, err := s.Rollups("/a", Daily, now.Add(-50*24*time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := int64(0)
+	for _, r := range rs {
+		total += r.Count
+	}
+	if total != 3 {
+		t.Errorf("rollups count %d hits, want 3", total)
+	}
+}
+
+func TestBoltStoreLegacyValues(t *testing.T) {
+	s, err := OpenBoltStore(filepath.Join(t.TempDir(), "links.db"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	err = s.DB().Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(pathsBucket).Put([]byte("/old"), []byte("https://old.example"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, err := s.Lookup("/old"); err != nil || l.URL != "https://old.example" {
+		t.Errorf("Lookup(/old) = %+v, %v", l, err)
+	}
+}
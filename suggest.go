@@ -0,0 +1,158 @@
+package urlshort
+
+import (
+	htmltemplate "html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxSuggestions is the number of links a suggestion page lists.
+const maxSuggestions = 10
+
+var suggestPage = htmltemplate.Must(htmltemplate.New("suggest").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>No link for {{.Path}}</title></head>
+<body>
+<h1>No link for {{.Path}}</h1>
+{{if .Links}}<p>Did you mean:</p>
+<ul>
+{{range .Links}}<li><a href="{{.Path}}">{{.Path}}</a> &rarr; {{.URL}}</li>
+{{end}}</ul>
+{{end}}{{if .Create}}<h2>Create it</h2>
+<form method="post" action="{{.Create}}">
+<input type="hidden" name="host" value="{{.Host}}">
+<input type="hidden" name="path" value="{{.Path}}">
+<input type="url" name="url" placeholder="https://" size="60" autofocus required>
+<input type="password" name="token" placeholder="admin token">
+<button type="submit">Create {{.Path}}</button>
+</form>
+{{end}}</body>
+</html>
+`))
+
+// SuggestHandler returns a handler for the requests matching no
+// link in t, meant as the fallback of the handler serving t. It
+// responds 404 Not Found with a page listing the links of the
+// request's host whose path is closest to the requested one:
+// those the requested path is a prefix of, or the other way
+// around, and those a few typos away. Links with a password or
+// a click limit are never listed, as showing their URL would get
+// around them.
+//
+// If createURL is not empty, the page also has a form to create
+// the missing link. It posts the host, path and url fields to
+// createURL, which API accepts at APIPrefix, along with a token
+// field for an API with a Token. Only offer the form where the
+// API is served to the same visitors.
+func SuggestHandler(t *Table, createURL string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, path := requestHost(r), r.URL.Path
+		data := struct {
+			Path, Host, Create string
+			Links              []Link
+		}{Path: path, Create: createURL}
+		data.Host, data.Links = t.routes().suggest(host, path, time.Now())
+		if createURL != "" && (path == "/" || strings.HasPrefix(data.Host, "*.")) {
+			// There is nothing to name, or no single host to put
+			// the link on.
+			data.Create = ""
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusNotFound)
+		suggestPage.Execute(w, data)
+	})
+}
+
+// suggest returns the links, among those serving host at now,
+// closest to path, best first, and the host pattern they belong
+// to. Links whose URL is not for everyone to see are left out.
+func (rt *routes) suggest(host, path string, now time.Time) (string, []Link) {
+	h, _ := resolveHost(host, func(h string) bool { return rt.hosts[h] != nil })
+	want := strings.ToLower(strings.Trim(path, "/"))
+	type scored struct {
+		l    Link
+		dist int
+	}
+	var found []scored
+	for _, l := range rt.links {
+		if l.Host != h || l.Expired(now) || l.PasswordHash != "" || l.MaxClicks > 0 {
+			continue
+		}
+		p := strings.ToLower(strings.Trim(strings.TrimSuffix(l.Path, "*"), "/"))
+		if p == "" || want == "" {
+			continue
+		}
+		// Allow a typo for every few characters.
+		max := len(want)/4 + 1
+		d, ok := editDistance(want, p, max)
+		if strings.HasPrefix(p, want) || strings.HasPrefix(want, p) {
+			ok = true
+		}
+		if ok {
+			found = append(found, scored{l, d})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].dist != found[j].dist {
+			return found[i].dist < found[j].dist
+		}
+		return found[i].l.Path < found[j].l.Path
+	})
+	if len(found) > maxSuggestions {
+		found = found[:maxSuggestions]
+	}
+	links := make([]Link, len(found))
+	for i, s := range found {
+		links[i] = s.l
+	}
+	return h, links
+}
+
+// editDistance returns the Levenshtein distance between a and b,
+// counted in bytes, and whether it is at most max. Past max, the
+// distance returned is only a lower bound.
+func editDistance(a, b string, max int) (int, bool) {
+	if d := len(a) - len(b); d > max || -d > max {
+		if d < 0 {
+			d = -d
+		}
+		return d, false
+	}
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		best := i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if cur[j] < best {
+				best = cur[j]
+			}
+		}
+		if best > max {
+			return best, false
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)], prev[len(b)] <= max
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,143 @@
+package urlshort
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEditDistance(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		max  int
+		want int
+		ok   bool
+	}{
+		{"docs", "docs", 1, 0, true},
+		{"dcos", "docs", 2, 2, true},
+		{"doc", "docs", 1, 1, true},
+		{"kitten", "sitting", 3, 3, true},
+		{"kitten", "sitting", 2, 3, false},
+		{"a", "abcdef", 2, 5, false},
+	} {
+		got, ok := editDistance(tt.a, tt.b, tt.max)
+		if ok != tt.ok || ok && got != tt.want {
+			t.Errorf("editDistance(%q, %q, %d) = %d, %v, want %d, %v", tt.a, tt.b, tt.max, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	table, err := NewTable([]Link{
+		{Path: "/docs", URL: "https://docs.example"},
+		{Path: "/docs-api", URL: "https://docs.example/api"},
+		{Path: "/dogs", URL: "https://dogs.example"},
+		{Path: "/gh/*", URL: "https://github.com/{rest}"},
+		{Path: "/old-docs", URL: "https://old.example", ExpiresAt: &past},
+		{Path: "/zebra", URL: "https://zebra.example"},
+		{Host: "go.corp", Path: "/dcos", URL: "https://corp.example"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		host, path string
+		want       string
+	}{
+		{"", "/docs-apo", "/docs-api /docs"},
+		{"", "/doc", "/docs /docs-api"},
+		{"", "/Dosc", "/docs /dogs"},
+		{"", "/ghub", "/gh/*"},
+		{"", "/nothing-like-it", ""},
+		{"go.corp", "/docs", "/dcos"},
+	} {
+		_, links := table.routes().suggest(tt.host, tt.path, time.Now())
+		var paths []string
+		for _, l := range links {
+			paths = append(paths, l.Path)
+		}
+		if got := strings.Join(paths, " "); got != tt.want {
+			t.Errorf("suggest(%q, %q) = %q, want %q", tt.host, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestSuggestHandler(t *testing.T) {
+	store := NewMemoryStore([]Link{
+		{Path: "/docs", URL: "https://docs.example"},
+		{Host: "*.example.com", Path: "/docs", URL: "https://wild.example"},
+	})
+	table, err := LoadTable(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := TableHandler(table, SuggestHandler(table, APIPrefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serve(h, "/dosc")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{`<a href="/docs">/docs</a>`, `action="/api/v1/links"`, `name="path" value="/dosc"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("page lacks %s:\n%s", want, body)
+		}
+	}
+	if body := serve(h, "/<script>").Body.String(); strings.Contains(body, "<script>") {
+		t.Errorf("path not escaped:\n%s", body)
+	}
+	// Links cannot be created for a wildcard host.
+	if body := serve(h, "http://s.example.com/dosc").Body.String(); strings.Contains(body, "<form") {
+		t.Errorf("form offered for a wildcard host:\n%s", body)
+	}
+
+	// Creating the link from the page.
+	api := NewAPI(store, table)
+	post := func(origin string) *httptest.ResponseRecorder {
+		form := url.Values{"host": {""}, "path": {"/dosc"}, "url": {"https://dosc.example"}}
+		r := httptest.NewRequest(http.MethodPost, "http://example.org"+APIPrefix, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Origin", origin)
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, r)
+		return rec
+	}
+	assertCode(t, post("https://evil.example"), http.StatusForbidden)
+	assertRedirect(t, post("http://example.org"), http.StatusSeeOther, "/dosc")
+	assertRedirect(t, serve(h, "/dosc"), http.StatusFound, "https://dosc.example")
+}
+
+func TestSuggestHidesProtectedLinks(t *testing.T) {
+	hash, err := HashPassword("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := NewTable([]Link{
+		{Path: "/secret-doc", URL: "https://internal.example/secret", PasswordHash: hash},
+		{Path: "/secret-dog", URL: "https://once.example/dog", MaxClicks: 1},
+		{Path: "/secret-dot", URL: "https://public.example/dot"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := TableHandler(table, SuggestHandler(table, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := serve(h, "/secret-do").Body.String()
+	for _, secret := range []string{"internal.example", "once.example"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("page shows %s:\n%s", secret, body)
+		}
+	}
+	if !strings.Contains(body, "https://public.example/dot") {
+		t.Errorf("page lacks the public link:\n%s", body)
+	}
+}
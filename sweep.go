@@ -0,0 +1,79 @@
+package urlshort
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// Sweep deletes the links in store that have expired at now and
+// returns how many were deleted. If table is not nil, they are
+// removed from it as well.
+func Sweep(store Store, table *Table, now time.Time) (int, error) {
+	links, err := store.List()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, l := range links {
+		if !l.Expired(now) {
+			continue
+		}
+		if err := store.Delete(l.Key()); err != nil && err != ErrNotFound {
+			return n, err
+		}
+		if table != nil {
+			if err := table.Remove(l.Key()); err != nil && err != ErrNotFound {
+				return n, err
+			}
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Sweeper runs Sweep in the background.
+type Sweeper struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// SweepExpired starts calling Sweep on store and table every
+// interval. Errors and purged links are written to logger, or to
+// standard error if it is nil. Call Close to stop.
+func SweepExpired(store Store, table *Table, interval time.Duration, logger *log.Logger) *Sweeper {
+	if logger == nil {
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	s := &Sweeper{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case now := <-tick.C:
+				n, err := Sweep(store, table, now)
+				if err != nil {
+					logger.Printf("urlshort: sweeping expired links: %v", err)
+				}
+				if n > 0 {
+					logger.Printf("urlshort: purged %d expired links", n)
+				}
+			}
+		}
+	}()
+	return s
+}
+
+// Close stops the sweeper.
+func (s *Sweeper) Close() error {
+	close(s.stop)
+	<-s.done
+	return nil
+}
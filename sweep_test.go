@@ -0,0 +1,63 @@
+package urlshort
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestExpiredLinks(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	links := []Link{
+		{Path: "/old", URL: "https://old.example", ExpiresAt: &past},
+		{Path: "/new", URL: "https://new.example", TTL: "1h"},
+		{Path: "/forever", URL: "https://forever.example"},
+	}
+	if err := checkRules(links, nil, ruleConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryStore(links)
+	table, err := LoadTable(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := TableHandler(table, http.HandlerFunc(fallback))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := serve(h, "/old"); rec.Code != http.StatusGone {
+		t.Errorf("expired link: status = %d, want 410", rec.Code)
+	}
+	assertRedirect(t, serve(h, "/new"), http.StatusFound, "https://new.example")
+
+	h, err = TableHandler(table, http.HandlerFunc(fallback), WithExpiredHandler(http.HandlerFunc(fallback)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFallback(t, serve(h, "/old"))
+
+	n, err := Sweep(store, table, time.Now().Add(2*time.Hour))
+	if err != nil || n != 2 {
+		t.Fatalf("Sweep() = %d, %v, want 2", n, err)
+	}
+	if table.Len() != 1 {
+		t.Errorf("table.Len() = %d after sweep, want 1", table.Len())
+	}
+	if _, err := store.Lookup("/forever"); err != nil {
+		t.Errorf("unexpiring link swept: %v", err)
+	}
+}
+
+func TestParseTTL(t *testing.T) {
+	links, _, err := parseYAML([]byte("- {path: /a, url: https://a.example, ttl: 30m}"), ruleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := links[0]; l.TTL != "" || l.ExpiresAt == nil || time.Until(*l.ExpiresAt) > 30*time.Minute {
+		t.Errorf("ttl not resolved: %+v", l)
+	}
+	if _, _, err := parseYAML([]byte("- {path: /a, url: https://a.example, ttl: soon}"), ruleConfig{}); err == nil {
+		t.Error("invalid ttl: expected an error")
+	}
+}
@@ -0,0 +1,277 @@
+package urlshort
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Table is a routing table that can be changed while it is
+// serving requests. Lookups are lock-free: they read the current
+// snapshot of compiled rules, which is never modified. Changes
+// copy the rules, compile the copy aside and swap it in
+// atomically, so a lookup always sees either the old or the new
+// set in full.
+type Table struct {
+	// Reload outcomes, updated atomically; first for alignment.
+	reloads, failedReloads uint64
+
+	store Store
+	mu    sync.Mutex   // serialises writers
+	rt    atomic.Value // *routes
+	cfg   ruleConfig   // guarded by mu
+}
+
+// NewTable returns a Table holding links.
+func NewTable(links []Link) (*Table, error) {
+	t := &Table{}
+	if err := t.Replace(links); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// LoadTable returns a Table holding the links in s. The table
+// remembers s, so Reload can read it again later.
+func LoadTable(s Store) (*Table, error) {
+	t := &Table{store: s}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Replace compiles links and swaps them in. If links contains an
+// invalid rule the table keeps its current content.
+func (t *Table) Replace(links []Link) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.swap(links)
+}
+
+// Add adds link to the table, replacing any link with the same
+// key.
+func (t *Table) Add(link Link) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.swap(t.with(link))
+}
+
+// with returns a copy of the links in the table, followed by
+// link. t.mu must be held.
+func (t *Table) with(link Link) []Link {
+	cur := t.routes().links
+	links := make([]Link, len(cur), len(cur)+1)
+	copy(links, cur)
+	return append(links, link)
+}
+
+// Remove removes the link stored under key. It returns
+// ErrNotFound if the table has no such link.
+func (t *Table) Remove(key string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cur := t.routes().links
+	links := make([]Link, 0, len(cur))
+	for _, l := range cur {
+		if l.Key() != key {
+			links = append(links, l)
+		}
+	}
+	if len(links) == len(cur) {
+		return ErrNotFound
+	}
+	return t.swap(links)
+}
+
+// SetPathNorm sets the normalizations applied to the paths of
+// links and requests, and compiles the links again with them.
+// If two links collide once normalized, it returns an error and
+// the table is left unchanged. The default is no normalization.
+func (t *Table) SetPathNorm(n PathNorm) error {
+	return t.configure(func(c *ruleConfig) { c.norm = n })
+}
+
+// SetTargetPolicy sets the policy the URLs of links must follow,
+// and checks the links again with it. If some are not allowed,
+// it returns an error and the table is left unchanged. The
+// default policy allows any http or https URL.
+func (t *Table) SetTargetPolicy(p TargetPolicy) error {
+	if err := p.check(); err != nil {
+		return err
+	}
+	return t.configure(func(c *ruleConfig) { c.targets = &p })
+}
+
+// SetChainPolicy sets the policy applied to links leading to
+// other links of the table, and checks the links again with it.
+// If some are rejected, it returns an error and the table is
+// left unchanged. By default such links are not looked at.
+func (t *Table) SetChainPolicy(p ChainPolicy) error {
+	if err := p.check(); err != nil {
+		return err
+	}
+	return t.configure(func(c *ruleConfig) { c.chains = &p })
+}
+
+// Configure applies the rule settings among opts, those of
+// WithPathNorm, WithTargetPolicy and WithChainPolicy, all at
+// once: if the links fail to compile with them, it returns an
+// error and the table is left unchanged. Other options are
+// ignored.
+func (t *Table) Configure(opts ...Option) error {
+	o := newOptions(opts)
+	if err := o.check(); err != nil {
+		return err
+	}
+	return t.configure(o.setRules)
+}
+
+// configure changes the configuration links are compiled with
+// and compiles them again, keeping the old configuration if
+// that fails.
+func (t *Table) configure(set func(*ruleConfig)) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old := t.cfg
+	set(&t.cfg)
+	if err := t.swap(t.routes().links); err != nil {
+		t.cfg = old
+		return err
+	}
+	return nil
+}
+
+// rules returns the configuration links are compiled with.
+func (t *Table) rules() ruleConfig {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cfg
+}
+
+// check reports why link cannot be added to the table, if it
+// cannot.
+func (t *Table) check(link Link) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, err := compile(t.with(link), t.cfg)
+	return err
+}
+
+// Reload replaces the content of a table created by LoadTable
+// with the links currently in its store. Tables created by
+// NewTable have nothing to reload from and are left unchanged.
+// Reloads are counted, see Reloads.
+func (t *Table) Reload() error {
+	if t.store == nil {
+		return nil
+	}
+	return t.countReload(t.load())
+}
+
+// Reloads returns the number of calls to Reload that succeeded
+// and failed, along with those of a Watcher of the table. The
+// first load, by LoadTable, is not counted.
+func (t *Table) Reloads() (succeeded, failed uint64) {
+	return atomic.LoadUint64(&t.reloads), atomic.LoadUint64(&t.failedReloads)
+}
+
+// countReload counts a reload ending with err, and returns err.
+func (t *Table) countReload(err error) error {
+	if err != nil {
+		atomic.AddUint64(&t.failedReloads, 1)
+	} else {
+		atomic.AddUint64(&t.reloads, 1)
+	}
+	return err
+}
+
+// load replaces the links in the table with those in its store.
+func (t *Table) load() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	links, err := t.store.List()
+	if err != nil {
+		return err
+	}
+	err = t.swap(links)
+	if errs, ok := err.(RuleErrors); ok {
+		if rl, ok := t.store.(ruleLiner); ok {
+			errs.locate(func(_ int, key string) int { return rl.ruleLine(key) })
+		}
+	}
+	return err
+}
+
+// ruleLiner is implemented by stores kept in a file, to point
+// at the rules that fail to load.
+type ruleLiner interface {
+	// ruleLine returns the line the link stored under key
+	// starts on, or 0 if it is not known.
+	ruleLine(key string) int
+}
+
+// swap compiles links and publishes them, logging the chain
+// warnings they bring. t.mu must be held.
+func (t *Table) swap(links []Link) error {
+	rt, err := compile(links, t.cfg)
+	if err != nil {
+		return err
+	}
+	old := t.routes()
+	t.rt.Store(rt)
+	if t.cfg.chains != nil {
+		t.cfg.chains.warn(rt.warnings, old.warnings)
+	}
+	return nil
+}
+
+// Links returns the links in the table. The slice must not be
+// modified.
+func (t *Table) Links() []Link {
+	return t.routes().links
+}
+
+// Len returns the number of links in the table.
+func (t *Table) Len() int {
+	return len(t.routes().links)
+}
+
+func (t *Table) routes() *routes {
+	if rt, ok := t.rt.Load().(*routes); ok {
+		return rt
+	}
+	return &routes{}
+}
+
+func (t *Table) lookup(host, path string) (match, bool) {
+	return t.routes().lookupHost(host, path)
+}
+
+// consume uses up a click of the link stored under key. Click
+// limits need a store implementing ClickCounter; without one,
+// click-limited links are treated as exhausted rather than
+// served without limit.
+func (t *Table) consume(key string) error {
+	cc, ok := t.store.(ClickCounter)
+	if !ok {
+		return ErrExhausted
+	}
+	_, err := cc.Consume(key)
+	return err
+}
+
+// TableHandler is like Handler but serves the rules in t, so
+// changes made to t are visible to the next request.
+func TableHandler(t *Table, fallback http.Handler, opts ...Option) (http.HandlerFunc, error) {
+	o := newOptions(opts)
+	if err := o.check(); err != nil {
+		return nil, err
+	}
+	if o.normSet || o.targets != nil || o.chains != nil {
+		if err := t.configure(o.setRules); err != nil {
+			return nil, err
+		}
+	}
+	return tableHandler(t, fallback, o), nil
+}
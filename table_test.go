@@ -0,0 +1,126 @@
+package urlshort
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestTableUpdates(t *testing.T) {
+	table, err := NewTable([]Link{{Path: "/a", URL: "https://a.example"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := TableHandler(table, http.HandlerFunc(fallback))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := table.Add(Link{Path: "/gh/*", URL: "https://github.com/{rest}"}); err != nil {
+		t.Fatal(err)
+	}
+	assertRedirect(t, serve(h, "/gh/golang"), http.StatusFound, "https://github.com/golang")
+
+	if err := table.Add(Link{Path: "/a", URL: "https://a2.example"}); err != nil {
+		t.Fatal(err)
+	}
+	assertRedirect(t, serve(h, "/a"), http.StatusFound, "https://a2.example")
+	if table.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", table.Len())
+	}
+
+	if err := table.Add(Link{Path: "/b", URL: "https://b.example/{id}"}); err == nil {
+		t.Error("Add with unbound placeholder: expected an error")
+	}
+	if err := table.Remove("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.Remove("/a"); err != ErrNotFound {
+		t.Errorf("second Remove: err = %v, want ErrNotFound", err)
+	}
+	assertFallback(t, serve(h, "/a"))
+
+	if err := table.Replace(nil); err != nil {
+		t.Fatal(err)
+	}
+	assertFallback(t, serve(h, "/gh/golang"))
+}
+
+// TestTableConcurrent is meant to be run with -race.
+func TestTableConcurrent(t *testing.T) {
+	table, err := NewTable(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := TableHandler(table, http.HandlerFunc(fallback))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers, readers, n = 4, 16, 200
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				path := fmt.Sprintf("/w%d/%d", w, i)
+				if err := table.Add(Link{Path: path, URL: "https://x.example" + path}); err != nil {
+					t.Error(err)
+					return
+				}
+				if i%3 == 0 {
+					table.Remove(path)
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				path := fmt.Sprintf("/w%d/%d", r%writers, i)
+				rec := serve(h, path)
+				if rec.Code == http.StatusFound && rec.Header().Get("Location") != "https://x.example"+path {
+					t.Errorf("%s redirected to %s", path, rec.Header().Get("Location"))
+				}
+				_ = table.Len()
+			}
+		}(r)
+	}
+	wg.Wait()
+
+	if want := writers * (n - (n+2)/3); table.Len() != want {
+		t.Errorf("Len() = %d, want %d", table.Len(), want)
+	}
+}
+
+func TestTableConfigure(t *testing.T) {
+	table, err := NewTable([]Link{
+		{Path: "/Docs", URL: "https://docs.example"},
+		{Path: "/a", URL: "https://go.corp/b"},
+		{Path: "/b", URL: "https://go.corp/a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The settings apply together or not at all.
+	err = table.Configure(WithPathNorm(FoldCase), WithChainPolicy(ChainPolicy{Hosts: []string{"go.corp"}}))
+	if err == nil {
+		t.Fatal("loop accepted")
+	}
+	if _, ok := table.lookup("", "/docs"); ok {
+		t.Error("path normalization applied despite the error")
+	}
+	if err := table.Configure(WithPathNorm(FoldCase), WithStatus(http.StatusMovedPermanently)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := table.lookup("", "/docs"); !ok {
+		t.Error("path normalization not applied")
+	}
+	if err := table.Configure(WithStatus(999)); err == nil {
+		t.Error("invalid option: expected an error")
+	}
+}
@@ -0,0 +1,144 @@
+package urlshort
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// template is a parsed redirect target. Targets are URLs in
+// which "{name}" is replaced by the path parameter of that name
+// and "{rest}" by the remainder matched by a wildcard; "{{"
+// stands for a literal brace.
+//
+// Substituted values are escaped for the part of the URL they
+// land in: path escaping before the query, query escaping
+// inside it.
+type template struct {
+	parts []tplPart
+}
+
+type tplPart struct {
+	lit   string
+	name  string // placeholder name, empty for literal parts
+	query bool   // placeholder sits in the query or fragment
+}
+
+func parseTemplate(s string) (*template, error) {
+	t := &template{}
+	var lit strings.Builder
+	query := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '{' && i+1 < len(s) && s[i+1] == '{':
+			lit.WriteByte('{')
+			i++
+		case c == '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated placeholder in %q", s)
+			}
+			name := s[i+1 : i+end]
+			if !validName(name) {
+				return nil, fmt.Errorf("invalid placeholder {%s} in %q", name, s)
+			}
+			if lit.Len() > 0 {
+				t.parts = append(t.parts, tplPart{lit: lit.String()})
+				lit.Reset()
+			}
+			t.parts = append(t.parts, tplPart{name: name, query: query})
+			i += end
+		default:
+			if c == '?' || c == '#' {
+				query = true
+			}
+			lit.WriteByte(c)
+		}
+	}
+	if lit.Len() > 0 {
+		t.parts = append(t.parts, tplPart{lit: lit.String()})
+	}
+	return t, nil
+}
+
+// names returns the placeholders used by t.
+func (t *template) names() []string {
+	var names []string
+	for _, p := range t.parts {
+		if p.name != "" {
+			names = append(names, p.name)
+		}
+	}
+	return names
+}
+
+// hostPlaceholder returns the first placeholder of t standing
+// in the scheme or the authority of the URL, where its value
+// could change the scheme or the host, or "" if there is none.
+func (t *template) hostPlaceholder() string {
+	var prefix strings.Builder
+	for _, p := range t.parts {
+		if p.name == "" {
+			prefix.WriteString(p.lit)
+			continue
+		}
+		if inAuthority(prefix.String()) {
+			return p.name
+		}
+		prefix.WriteString("x")
+	}
+	return ""
+}
+
+// inAuthority reports whether text following prefix, the start
+// of a URL, is part of its scheme or authority. Prefixes that
+// could still go either way count as in it.
+func inAuthority(prefix string) bool {
+	colon := strings.IndexByte(prefix, ':')
+	if colon < 0 {
+		// Still in the scheme, unless the URL is relative.
+		return !strings.ContainsAny(prefix, "/?#")
+	}
+	rest := prefix[colon+1:]
+	if len(rest) < 2 {
+		return strings.HasPrefix("//", rest)
+	}
+	return strings.HasPrefix(rest, "//") && !strings.ContainsAny(rest[2:], "/?#")
+}
+
+// expand renders t, looking placeholder values up with value.
+func (t *template) expand(value func(name string) string) string {
+	var b strings.Builder
+	for _, p := range t.parts {
+		if p.name == "" {
+			b.WriteString(p.lit)
+			continue
+		}
+		v := value(p.name)
+		switch {
+		case p.query:
+			b.WriteString(url.QueryEscape(v))
+		case p.name == restPlaceholder:
+			// The remainder may span several segments, so its
+			// slashes are kept.
+			b.WriteString((&url.URL{Path: v}).EscapedPath())
+		default:
+			b.WriteString(url.PathEscape(v))
+		}
+	}
+	return b.String()
+}
+
+// validName reports whether s can name a path parameter.
+func validName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,229 @@
+package urlshort
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TargetPolicy restricts the URLs links may redirect to. Every
+// URL must be absolute. Placeholders are only allowed in the
+// path, query and fragment, so whatever they expand to, the
+// scheme and host are the same.
+type TargetPolicy struct {
+	// Schemes lists the allowed URL schemes, "*" allowing any.
+	// Empty means http and https.
+	Schemes []string
+	// AllowHosts, if not empty, lists the only hosts URLs may
+	// point to. As in Link.Host, "*.example.com" stands for the
+	// subdomains of example.com.
+	AllowHosts []string
+	// DenyHosts lists hosts URLs may not point to, in the same
+	// format. It wins over AllowHosts.
+	DenyHosts []string
+}
+
+var defaultSchemes = []string{"http", "https"}
+
+// anyTarget lets any absolute URL through.
+var anyTarget = &TargetPolicy{Schemes: []string{"*"}}
+
+// check reports invalid host patterns in p.
+func (p *TargetPolicy) check() error {
+	for _, hosts := range [][]string{p.AllowHosts, p.DenyHosts} {
+		for _, h := range hosts {
+			if h == "" {
+				return errors.New("urlshort: empty host in target policy")
+			}
+			if err := checkHost(h); err != nil {
+				return fmt.Errorf("urlshort: target policy: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkURL reports why target, with its placeholders expanded,
+// is not allowed by p. A nil policy is the default one.
+func (p *TargetPolicy) checkURL(target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("invalid url: %v", err)
+	}
+	if u.Scheme == "" {
+		return fmt.Errorf("url %q is not absolute", target)
+	}
+	scheme := strings.ToLower(u.Scheme)
+	schemes := defaultSchemes
+	if p != nil && len(p.Schemes) > 0 {
+		schemes = p.Schemes
+	}
+	allowed := false
+	for _, s := range schemes {
+		allowed = allowed || s == "*" || strings.EqualFold(s, scheme)
+	}
+	if !allowed {
+		return fmt.Errorf("url scheme %q is not allowed", u.Scheme)
+	}
+	if u.Host == "" && (u.Opaque == "" || scheme == "http" || scheme == "https") {
+		return fmt.Errorf("url %q has no host", target)
+	}
+	if p == nil {
+		return nil
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if matchHost(p.DenyHosts, host) {
+		return fmt.Errorf("url host %q is denied", host)
+	}
+	if len(p.AllowHosts) > 0 && !matchHost(p.AllowHosts, host) {
+		return fmt.Errorf("url host %q is not allowed", host)
+	}
+	return nil
+}
+
+// matchHost reports whether host is one of hosts, or below one
+// of its wildcards.
+func matchHost(hosts []string, host string) bool {
+	if host == "" {
+		return false
+	}
+	for _, h := range hosts {
+		if h == host || strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleConfig is what rules are checked and compiled with.
+type ruleConfig struct {
+	norm    PathNorm
+	targets *TargetPolicy // nil for the default policy
+	chains  *ChainPolicy  // nil to leave chains alone
+}
+
+// RuleError describes what is wrong with one rule.
+type RuleError struct {
+	Line int    // where the rule starts in its file, 0 if unknown
+	Key  string // the rule's key, see Link.Key
+	Err  error
+
+	index int // position of the rule in the list checked
+}
+
+func (e *RuleError) Error() string {
+	msg := e.Err.Error()
+	if e.Key != "" {
+		msg = e.Key + ": " + msg
+	}
+	if e.Line > 0 {
+		msg = fmt.Sprintf("line %d: %s", e.Line, msg)
+	}
+	return msg
+}
+
+// RuleErrors is returned when rules are loaded, listing every
+// invalid rule, in the order they appear.
+type RuleErrors []*RuleError
+
+func (e RuleErrors) Error() string {
+	if len(e) == 1 {
+		return "urlshort: " + e[0].Error()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "urlshort: %d invalid rules:", len(e))
+	for _, re := range e {
+		b.WriteString("\n\t")
+		b.WriteString(re.Error())
+	}
+	return b.String()
+}
+
+// locate sets the line of each error with line, then orders the
+// errors by line.
+func (e RuleErrors) locate(line func(index int, key string) int) {
+	for _, re := range e {
+		re.Line = line(re.index, re.Key)
+	}
+	sort.SliceStable(e, func(i, j int) bool { return e[i].Line < e[j].Line })
+}
+
+// checkRules resolves the TTLs of links and checks them with
+// cfg. lines holds the line each link starts on, or is nil.
+func checkRules(links []Link, lines []int, cfg ruleConfig) error {
+	var errs RuleErrors
+	now := time.Now()
+	for i := range links {
+		if err := resolveTTL(&links[i], now); err != nil {
+			errs = append(errs, &RuleError{Key: links[i].Key(), Err: err, index: i})
+		}
+	}
+	if _, err := compile(links, cfg); err != nil {
+		errs = append(errs, err.(RuleErrors)...)
+	}
+	if errs == nil {
+		return nil
+	}
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].index < errs[j].index })
+	if lines != nil {
+		errs.locate(func(i int, _ string) int { return lines[i] })
+	}
+	return errs
+}
+
+// yamlLines returns the line each item of the top-level sequence
+// in data starts on, or nil if there are not n of them, as when
+// the sequence is written in flow style.
+func yamlLines(data []byte, n int) []int {
+	var lines []int
+	indent := -1
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || trimmed[0] == '#' || strings.HasPrefix(line, "---") {
+			continue
+		}
+		if indent < 0 {
+			indent = len(line) - len(trimmed)
+		}
+		if len(line)-len(trimmed) == indent && (trimmed == "-" || strings.HasPrefix(trimmed, "- ")) {
+			lines = append(lines, i+1)
+		}
+	}
+	if len(lines) != n {
+		return nil
+	}
+	return lines
+}
+
+// jsonLines is the JSON counterpart of yamlLines.
+func jsonLines(data []byte, n int) []int {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil
+	}
+	var lines []int
+	line, off := 1, 0
+	for dec.More() {
+		next := int(dec.InputOffset())
+		for next < len(data) && (data[next] == ',' || data[next] == ' ' || data[next] == '\t' || data[next] == '\r' || data[next] == '\n') {
+			next++
+		}
+		line += bytes.Count(data[off:next], []byte("\n"))
+		off = next
+		lines = append(lines, line)
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil
+		}
+	}
+	if len(lines) != n {
+		return nil
+	}
+	return lines
+}
@@ -0,0 +1,189 @@
+package urlshort
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRuleErrors(t *testing.T) {
+	yml := `# links
+- path: /ok
+  url: https://ok.example
+
+- path: /js
+  url: javascript:alert(1)
+- path: relative
+  url: https://x.example
+- {path: /empty, url: ""}
+- path: /rel
+  url: /elsewhere
+- path: ""
+  url: https://x.example
+- path: /ttl
+  url: https://x.example
+  ttl: soon
+`
+	_, err := YAMLHandler([]byte(yml), http.HandlerFunc(fallback))
+	errs, ok := err.(RuleErrors)
+	if !ok {
+		t.Fatalf("err = %v, want RuleErrors", err)
+	}
+	want := []string{
+		`line 5: /js: url scheme "javascript" is not allowed`,
+		`line 7: relative: path "relative" does not start with /`,
+		`line 9: /empty: url is empty`,
+		`line 10: /rel: url "/elsewhere" is not absolute`,
+		`line 12: path is empty`,
+		`line 14: /ttl: invalid ttl "soon"`,
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("got %d errors, want %d:\n%v", len(errs), len(want), err)
+	}
+	for i, w := range want {
+		if got := errs[i].Error(); got != w {
+			t.Errorf("error %d = %q, want %q", i, got, w)
+		}
+	}
+	if !strings.HasPrefix(err.Error(), "urlshort: 6 invalid rules:\n\tline 5: ") {
+		t.Errorf("Error() = %q", err)
+	}
+
+	js := `[
+  {"path": "/ok", "url": "https://ok.example"},
+  {"path": "/a", "url": "ftp://files.example/a"},
+
+  {
+    "path": "/b",
+    "url": "https:"
+  }
+]`
+	_, err = JSONHandler([]byte(js), http.HandlerFunc(fallback))
+	if got := err.Error(); got != "urlshort: 2 invalid rules:\n\tline 3: /a: url scheme \"ftp\" is not allowed\n\tline 5: /b: url \"https:\" has no host" {
+		t.Errorf("JSON errors = %q", got)
+	}
+
+	// Flow style sequences have no line numbers.
+	_, err = YAMLHandler([]byte(`[{path: /x, url: "data:text/html,hi"}]`), http.HandlerFunc(fallback))
+	if got := err.Error(); got != `urlshort: /x: url scheme "data" is not allowed` {
+		t.Errorf("flow YAML error = %q", got)
+	}
+}
+
+func TestTargetPolicy(t *testing.T) {
+	p := TargetPolicy{
+		Schemes:    []string{"https", "mailto"},
+		AllowHosts: []string{"*.corp.example", "docs.example"},
+		DenyHosts:  []string{"bad.corp.example"},
+	}
+	for target, ok := range map[string]bool{
+		"https://docs.example/x":            true,
+		"https://DOCS.example./x":           true,
+		"https://wiki.corp.example":         true,
+		"https://corp.example/{sub}":        false,
+		"https://wiki.corp.example/{sub}":   true,
+		"https://{sub}.corp.example":        false,
+		"https://wiki.corp.example:{sub}/":  false,
+		"{sub}://wiki.corp.example":         false,
+		"https://corp.example":              false,
+		"https://bad.corp.example":          false,
+		"https://evil.example":              false,
+		"http://docs.example":               false,
+		"mailto:someone@docs.example":       false,
+		"https://docs.example@evil.example": false,
+	} {
+		l := Link{Path: "/x/:sub", URL: target}
+		if _, err := newRule(l, &p); (err == nil) != ok {
+			t.Errorf("%s: err = %v, want allowed %v", target, err, ok)
+		}
+	}
+
+	// Placeholders cannot move the URL to another host, be it
+	// denied or outside the allowed ones.
+	for _, tt := range []struct {
+		link   Link
+		policy *TargetPolicy
+	}{
+		{Link{Path: "/r/*", URL: "https://{rest}.example.com"}, &TargetPolicy{AllowHosts: []string{"*.example.com"}}},
+		{Link{Path: "/go/:sub", URL: "https://{sub}.corp.example/"}, &TargetPolicy{DenyHosts: []string{"bad.corp.example"}}},
+		{Link{Path: "/go/:sub", URL: "https://{sub}.corp.example/"}, nil},
+	} {
+		_, err := newRule(tt.link, tt.policy)
+		if err == nil || !strings.Contains(err.Error(), "placeholder {") {
+			t.Errorf("%s: err = %v, want a placeholder error", tt.link.URL, err)
+		}
+	}
+
+	if _, err := newRule(Link{Path: "/m", URL: "mailto:someone@corp.example"}, &TargetPolicy{Schemes: []string{"mailto"}}); err != nil {
+		t.Errorf("mailto: %v", err)
+	}
+	if _, err := newRule(Link{Path: "/j", URL: "javascript:alert(1)"}, anyTarget); err != nil {
+		t.Errorf("any scheme: %v", err)
+	}
+	if _, err := Handler(NewMemoryStore(nil), nil, WithTargetPolicy(TargetPolicy{AllowHosts: []string{"Bad Host"}})); err == nil {
+		t.Error("invalid host in policy: expected an error")
+	}
+
+	// A table refusing the policy keeps its links; the API then
+	// checks new links against it.
+	store := NewMemoryStore([]Link{{Path: "/docs", URL: "https://docs.example"}})
+	table, err := LoadTable(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TableHandler(table, nil, WithTargetPolicy(TargetPolicy{AllowHosts: []string{"other.example"}})); err == nil {
+		t.Error("TableHandler: expected an error")
+	}
+	if table.Len() != 1 {
+		t.Errorf("table has %d links, want 1", table.Len())
+	}
+	if _, err := TableHandler(table, nil, WithTargetPolicy(p)); err != nil {
+		t.Fatal(err)
+	}
+	api := NewAPI(store, table)
+	assertCode(t, apiRequest(t, api, "POST", "/api/v1/links", `{"path": "/e", "url": "https://evil.example"}`), http.StatusBadRequest)
+	assertCode(t, apiRequest(t, api, "POST", "/api/v1/links", `{"path": "/w", "url": "https://wiki.corp.example"}`), http.StatusCreated)
+}
+
+func TestFileStoreRuleLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "links.yaml")
+	yml := `- path: /a
+  url: https://a.example
+- path: /b
+  url: javascript:alert(1)
+`
+	if err := ioutil.WriteFile(path, []byte(yml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The store takes any absolute URL; the table enforces the
+	// default policy and points at the line of the culprit.
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadTable(s)
+	if err == nil || err.Error() != `urlshort: line 3: /b: url scheme "javascript" is not allowed` {
+		t.Errorf("err = %v", err)
+	}
+
+	// Lines follow the file as it is rewritten.
+	if err := s.Delete("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(Link{Path: "/0", URL: "https://0.example"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadTable(s)
+	if errs, ok := err.(RuleErrors); !ok || errs[0].Line != 3 {
+		t.Errorf("err after rewrite = %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("- path: /a\n  url: https://a.example\n- path: a\n  url: https://b.example\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err == nil || !strings.Contains(err.Error(), "line 3: a: path") {
+		t.Errorf("Reload: err = %v", err)
+	}
+}
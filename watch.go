@@ -0,0 +1,151 @@
+package urlshort
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ReloadStatus describes the outcome of the latest reload done
+// by a Watcher.
+type ReloadStatus struct {
+	File        string    `json:"file"`
+	Links       int       `json:"links"`
+	LastAttempt time.Time `json:"last_attempt"`
+	LastSuccess time.Time `json:"last_success"`
+	// Error is the reason the latest attempt failed, empty when
+	// it succeeded. The table keeps serving the last good rules
+	// until the file is fixed.
+	Error string `json:"error,omitempty"`
+	// Successes and Failures count the reloads attempted since
+	// the watcher started.
+	Successes int64 `json:"successes"`
+	Failures  int64 `json:"failures"`
+}
+
+// Watcher polls the file behind a FileStore and, whenever it
+// changes, reloads the store and the Table serving it.
+type Watcher struct {
+	store    *FileStore
+	table    *Table
+	interval time.Duration
+	logger   *log.Logger
+
+	mu     sync.Mutex
+	status ReloadStatus
+
+	mtime time.Time // last seen by loop
+	size  int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// WatchFile starts watching the file behind store, checking it
+// for changes every interval. table must have been loaded from
+// store with LoadTable. Reload results are written to logger, or
+// to standard error if it is nil. Call Close to stop.
+func WatchFile(store *FileStore, table *Table, interval time.Duration, logger *log.Logger) *Watcher {
+	if logger == nil {
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	w := &Watcher{
+		store:    store,
+		table:    table,
+		interval: interval,
+		logger:   logger,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	now := time.Now()
+	w.status = ReloadStatus{File: store.Path(), Links: table.Len(), LastAttempt: now, LastSuccess: now}
+	w.mtime, w.size = w.stat()
+	go w.loop()
+	return w
+}
+
+func (w *Watcher) loop() {
+	defer close(w.done)
+	tick := time.NewTicker(w.interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-tick.C:
+			mtime, size := w.stat()
+			if mtime.Equal(w.mtime) && size == w.size {
+				continue
+			}
+			w.mtime, w.size = mtime, size
+			w.Reload()
+		}
+	}
+}
+
+func (w *Watcher) stat() (time.Time, int64) {
+	fi, err := os.Stat(w.store.Path())
+	if err != nil {
+		return time.Time{}, -1
+	}
+	return fi.ModTime(), fi.Size()
+}
+
+// Reload reloads the file right away, whether or not it changed.
+func (w *Watcher) Reload() error {
+	// The store checks the file as the table will, so it never
+	// holds links the table refuses. The configuration is read
+	// before the store locks its file, the reverse of the order
+	// Table.Reload takes the two locks in.
+	err := w.store.reload(w.table.rules())
+	if err == nil {
+		err = w.table.Reload()
+	} else {
+		w.table.countReload(err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.status.LastAttempt = time.Now()
+	if err != nil {
+		w.status.Failures++
+		w.status.Error = err.Error()
+		w.logger.Printf("urlshort: reload of %s failed, keeping %d rules: %v", w.status.File, w.status.Links, err)
+		return err
+	}
+	w.status.Successes++
+	w.status.Error = ""
+	w.status.LastSuccess = w.status.LastAttempt
+	w.status.Links = w.table.Len()
+	w.logger.Printf("urlshort: reloaded %s: %d rules", w.status.File, w.status.Links)
+	return nil
+}
+
+// Status returns the outcome of the latest reload.
+func (w *Watcher) Status() ReloadStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.status
+}
+
+// ServeHTTP reports the reload status as JSON. The response is
+// 200 OK when the latest reload succeeded and 500 otherwise, so
+// the endpoint can back a health check.
+func (w *Watcher) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	st := w.Status()
+	rw.Header().Set("Content-Type", "application/json")
+	if st.Error != "" {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(rw).Encode(st)
+}
+
+// Close stops watching the file.
+func (w *Watcher) Close() error {
+	close(w.stop)
+	<-w.done
+	return nil
+}
@@ -0,0 +1,100 @@
+package urlshort
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatcherReloads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "links.yaml")
+	writeFile(t, path, "- {path: /a, url: https://a.example}\n")
+
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := LoadTable(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := WatchFile(store, table, 5*time.Millisecond, log.New(ioutil.Discard, "", 0))
+	defer w.Close()
+	h, err := TableHandler(table, http.HandlerFunc(fallback))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, path, "- {path: /a, url: https://a.example}\n- {path: /b, url: https://b.example}\n")
+	waitFor(t, func() bool { return table.Len() == 2 })
+	assertRedirect(t, serve(h, "/b"), http.StatusFound, "https://b.example")
+
+	// An invalid file is reported but the last good rules stay.
+	writeFile(t, path, "- {path: /c, url: https://c.example/{oops}\n")
+	waitFor(t, func() bool { return w.Status().Error != "" })
+	assertRedirect(t, serve(h, "/b"), http.StatusFound, "https://b.example")
+	if rec := serve(w, "/_status/reload"); rec.Code != http.StatusInternalServerError {
+		t.Errorf("status endpoint after failed reload = %d, want 500", rec.Code)
+	}
+
+	writeFile(t, path, "- {path: /c, url: https://c.example}\n")
+	waitFor(t, func() bool { return w.Status().Error == "" })
+	assertRedirect(t, serve(h, "/c"), http.StatusFound, "https://c.example")
+	assertFallback(t, serve(h, "/a"))
+	if st := w.Status(); st.Successes < 2 || st.Failures < 1 {
+		t.Errorf("status counts %d successes and %d failures", st.Successes, st.Failures)
+	}
+}
+
+func TestWatcherKeepsStoreInSync(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "links.yaml")
+	writeFile(t, path, "- {path: /a, url: https://a.example}\n")
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := LoadTable(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := table.SetTargetPolicy(TargetPolicy{AllowHosts: []string{"a.example"}}); err != nil {
+		t.Fatal(err)
+	}
+	w := WatchFile(store, table, time.Hour, log.New(ioutil.Discard, "", 0))
+	defer w.Close()
+
+	// A file the table refuses is refused by the store too, so
+	// the API does not see links that are not served.
+	writeFile(t, path, "- {path: /a, url: https://a.example}\n- {path: /b, url: https://b.example}\n")
+	if err := w.Reload(); err == nil || !strings.Contains(err.Error(), "line 2: /b:") {
+		t.Fatalf("err = %v, want one for /b", err)
+	}
+	if _, err := store.Lookup("/b"); err != ErrNotFound {
+		t.Errorf("store took the refused link: err = %v", err)
+	}
+	if links, _ := store.List(); len(links) != table.Len() {
+		t.Errorf("store has %d links, table %d", len(links), table.Len())
+	}
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}